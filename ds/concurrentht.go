@@ -0,0 +1,129 @@
+package ds
+
+import (
+	"math/bits"
+	"sync"
+)
+
+/*
+ ConcurrentIntHashTable is an IntHashTable safe for concurrent use. Keys are
+ spread over shards by the top bits of their hash, each shard is an
+ IntHashTable of its own with a lock of its own. Reads take the read lock
+ of one shard, so they go on while other shards are written to and while
+ other reads of the same shard are going on, a write only waits for the
+ shard it writes to. Growing a shard replaces the buffer of that shard
+ alone.
+
+ The top bits pick the shard as the table of a shard takes its slot from
+ the hash modulo its size, which mostly depends on the low bits.
+*/
+
+type ConcurrentIntHashTable struct {
+	shards []concurrentShard
+	// bits of the hash that pick the shard
+	shardBits int
+	seed      int64
+	tab       *[4][256]int
+}
+
+type concurrentShard struct {
+	sync.RWMutex
+	table IntHashTable
+	// keeps shards on separate cache lines
+	_ [64]byte
+}
+
+// CreateConcurrentIntHashTable returns a table of at least numShards shards,
+// rounded up to a power of two, with room for initialCapacity pairs in all.
+func CreateConcurrentIntHashTable(numShards int, initialCapacity uint32, seed int64) *ConcurrentIntHashTable {
+	shardBits := 0
+	if numShards > 1 {
+		shardBits = bits.Len(uint(numShards - 1))
+	}
+	cht := &ConcurrentIntHashTable{shardBits: shardBits, seed: seed, tab: tabHashTablesOf(seed)}
+	cht.shards = make([]concurrentShard, 1<<shardBits)
+	for i := range cht.shards {
+		cht.shards[i].table = CreateIntHashTableWithSeed(initialCapacity>>shardBits+1, seed)
+	}
+	return cht
+}
+
+func (cht *ConcurrentIntHashTable) shard(k uint32) *concurrentShard {
+	if cht.shardBits == 0 {
+		return &cht.shards[0]
+	}
+	h := (&IntHashTable{tab: cht.tab}).hash(k)
+	return &cht.shards[h>>(32-cht.shardBits)]
+}
+
+func (cht *ConcurrentIntHashTable) Put(k, v uint32) {
+	s := cht.shard(k)
+	s.Lock()
+	defer s.Unlock()
+	s.table.Put(k, v)
+}
+
+// Add puts k and v without replacing the values k already has.
+func (cht *ConcurrentIntHashTable) Add(k, v uint32) {
+	s := cht.shard(k)
+	s.Lock()
+	defer s.Unlock()
+	s.table.Add(k, v)
+}
+
+func (cht *ConcurrentIntHashTable) Get(k uint32) (uint32, bool) {
+	s := cht.shard(k)
+	s.RLock()
+	defer s.RUnlock()
+	return s.table.Get(k)
+}
+
+// GetAll calls f with every value of k until f returns false. The shard of k
+// is read locked meanwhile, f must not write to the table.
+func (cht *ConcurrentIntHashTable) GetAll(k uint32, f func(v uint32) bool) {
+	s := cht.shard(k)
+	s.RLock()
+	defer s.RUnlock()
+	s.table.GetAll(k, f)
+}
+
+// Delete removes every value of k and reports whether there was one.
+func (cht *ConcurrentIntHashTable) Delete(k uint32) bool {
+	s := cht.shard(k)
+	s.Lock()
+	defer s.Unlock()
+	return s.table.Delete(k)
+}
+
+// DeleteValue removes the pair of k and v, one of them if it was added more
+// than once, and reports whether there was one.
+func (cht *ConcurrentIntHashTable) DeleteValue(k, v uint32) bool {
+	s := cht.shard(k)
+	s.Lock()
+	defer s.Unlock()
+	return s.table.DeleteValue(k, v)
+}
+
+// Len returns the number of key value pairs in the table. Shards are counted
+// one after the other, writes in between may or may not be counted.
+func (cht *ConcurrentIntHashTable) Len() int {
+	n := 0
+	for i := range cht.shards {
+		s := &cht.shards[i]
+		s.RLock()
+		n += s.table.Len()
+		s.RUnlock()
+	}
+	return n
+}
+
+// ForAll calls f with every pair, a shard at a time. The shard is read
+// locked meanwhile, f must not write to the table.
+func (cht *ConcurrentIntHashTable) ForAll(f func(k, v uint32)) {
+	for i := range cht.shards {
+		s := &cht.shards[i]
+		s.RLock()
+		s.table.ForAll(f)
+		s.RUnlock()
+	}
+}
@@ -0,0 +1,68 @@
+package ds
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestChtConcurrentPutGet(t *testing.T) {
+	cht := CreateConcurrentIntHashTable(6, 16, DefaultSeed)
+	if len(cht.shards) != 8 {
+		t.Errorf("expected 8 shards but got %d", len(cht.shards))
+	}
+	var wg sync.WaitGroup
+	for w := uint32(0); w < 4; w++ {
+		wg.Add(2)
+		go func(w uint32) {
+			defer wg.Done()
+			for i := w; i < 4000; i += 4 {
+				cht.Put(i, 2*i)
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := uint32(0); i < 4000; i++ {
+				if v, found := cht.Get(i); found && v != 2*i {
+					t.Errorf("expected %d but got %d", 2*i, v)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if cht.Len() != 4000 {
+		t.Errorf("expected 4000 pairs but got %d", cht.Len())
+	}
+	for i := uint32(0); i < 4000; i++ {
+		if v, found := cht.Get(i); !found || v != 2*i {
+			t.Errorf("expected %d but got %d, %v", 2*i, v, found)
+		}
+	}
+}
+
+func TestChtAddDelete(t *testing.T) {
+	cht := CreateConcurrentIntHashTable(4, 0, 3)
+	cht.Add(1, 10)
+	cht.Add(1, 11)
+	cht.Add(2, 20)
+	values := 0
+	cht.GetAll(1, func(v uint32) bool {
+		values++
+		return true
+	})
+	if values != 2 {
+		t.Errorf("expected 2 values but got %d", values)
+	}
+	if !cht.DeleteValue(1, 10) || !cht.Delete(2) || cht.Delete(3) {
+		t.Error("unexpected deletes")
+	}
+	pairs := 0
+	cht.ForAll(func(k, v uint32) {
+		if k != 1 || v != 11 {
+			t.Errorf("unexpected pair %d %d", k, v)
+		}
+		pairs++
+	})
+	if pairs != 1 || cht.Len() != 1 {
+		t.Errorf("expected 1 pair but got %d", pairs)
+	}
+}
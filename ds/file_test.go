@@ -0,0 +1,25 @@
+package ds
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	for _, contents := range []string{"first", "second"} {
+		if err := WriteFileAtomic(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		bs, err := ioutil.ReadFile(path)
+		if err != nil || string(bs) != contents {
+			t.Errorf("expected %s but got %s, %v", contents, bs, err)
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("expected no temporary files to be left but got %v", entries)
+	}
+}
@@ -0,0 +1,388 @@
+package ds
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/bits"
+)
+
+/*
+ HashTable is IntHashTable for keys and values of any fixed width, e.g.
+ uint64 keys, a struct of mtime and size as the value or strings interned
+ to ids as keys. A Codec turns keys and values into bytes of its Size, a
+ slot is the flag byte followed by the bytes of the key and of the value.
+ The table is a flat buffer as IntHashTable is, it saves to a file and maps
+ read only the same way.
+
+ Keys are told apart by their bytes, keys that are equal have to encode to
+ the same bytes. Every key has one value, there is no Add.
+*/
+
+// Codec encodes values of T in exactly Size bytes.
+type Codec[T any] interface {
+	Size() int
+	Encode(b []byte, v T) error
+	Decode(b []byte) (T, error)
+}
+
+type Uint32Codec struct{}
+
+func (Uint32Codec) Size() int { return 4 }
+
+func (Uint32Codec) Encode(b []byte, v uint32) error {
+	binary.LittleEndian.PutUint32(b, v)
+	return nil
+}
+
+func (Uint32Codec) Decode(b []byte) (uint32, error) {
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+type Uint64Codec struct{}
+
+func (Uint64Codec) Size() int { return 8 }
+
+func (Uint64Codec) Encode(b []byte, v uint64) error {
+	binary.LittleEndian.PutUint64(b, v)
+	return nil
+}
+
+func (Uint64Codec) Decode(b []byte) (uint64, error) {
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// FixedCodec is a Codec from a pair of functions, for structs of fixed size
+// fields.
+type FixedCodec[T any] struct {
+	Width int
+	Put   func(b []byte, v T)
+	Read  func(b []byte) T
+}
+
+func (c FixedCodec[T]) Size() int { return c.Width }
+
+func (c FixedCodec[T]) Encode(b []byte, v T) error {
+	c.Put(b, v)
+	return nil
+}
+
+func (c FixedCodec[T]) Decode(b []byte) (T, error) {
+	return c.Read(b), nil
+}
+
+// StringInterner hands out ids of strings, as lib.Stringids does.
+type StringInterner interface {
+	GetId(s string) (uint32, error)
+	StrAt(id uint32) (string, error)
+}
+
+// InternedStringCodec encodes strings as their ids in Ids. Only strings Ids
+// already has can be encoded.
+type InternedStringCodec struct {
+	Ids StringInterner
+}
+
+func (InternedStringCodec) Size() int { return 4 }
+
+func (c InternedStringCodec) Encode(b []byte, s string) error {
+	id, err := c.Ids.GetId(s)
+	if err != nil {
+		return fmt.Errorf("no id for %q: %v", s, err)
+	}
+	binary.LittleEndian.PutUint32(b, id)
+	return nil
+}
+
+func (c InternedStringCodec) Decode(b []byte) (string, error) {
+	return c.Ids.StrAt(binary.LittleEndian.Uint32(b))
+}
+
+type HashTable[K, V any] struct {
+	keys   Codec[K]
+	values Codec[V]
+	ba     []byte
+	// flag + key + value
+	slotSize uint32
+	// live pairs and tombstones
+	count      uint32
+	tombstones uint32
+	seed       int64
+	// tabulation tables of seed, nil for DefaultSeed
+	tab *[4][256]int
+	// set for a table mapped from a file
+	unmap func() error
+}
+
+// CreateHashTable returns a table with room for initialCapacity pairs whose
+// keys and values are encoded by keys and values.
+func CreateHashTable[K, V any](keys Codec[K], values Codec[V], initialCapacity uint32, seed int64) *HashTable[K, V] {
+	if initialCapacity == 0 {
+		initialCapacity = 1
+	}
+	ht := &HashTable[K, V]{keys: keys, values: values, seed: seed, tab: tabHashTablesOf(seed)}
+	ht.slotSize = uint32(1 + keys.Size() + values.Size())
+	ht.ba = make([]byte, initialCapacity*ht.slotSize)
+	return ht
+}
+
+// hash is the hash of IntHashTable for 4 byte keys, longer keys rotate the
+// tables by the word the byte is in.
+func (ht *HashTable[K, V]) hash(kb []byte) uint32 {
+	tab := ht.tab
+	if tab == nil {
+		tab = tabHashTables
+	}
+	h := uint32(0)
+	for i, b := range kb {
+		h ^= bits.RotateLeft32(uint32(tab[i&3][b]), i>>2)
+	}
+	return h
+}
+
+func (ht *HashTable[K, V]) numSlots() uint32 {
+	return uint32(len(ht.ba)) / ht.slotSize
+}
+
+func (ht *HashTable[K, V]) checkWritable() {
+	if ht.unmap != nil {
+		panic("ds: write to a read only hash table")
+	}
+}
+
+func (ht *HashTable[K, V]) keyAt(slotByteLoc uint32) []byte {
+	return ht.ba[slotByteLoc+1 : slotByteLoc+1+uint32(ht.keys.Size())]
+}
+
+func (ht *HashTable[K, V]) valueAt(slotByteLoc uint32) []byte {
+	return ht.ba[slotByteLoc+1+uint32(ht.keys.Size()) : slotByteLoc+ht.slotSize]
+}
+
+// find returns the location of the slot of kb.
+func (ht *HashTable[K, V]) find(kb []byte) (uint32, bool) {
+	numSlots := ht.numSlots()
+	slot := ht.hash(kb) % numSlots
+	for firstSlot := slot; slot-firstSlot <= numSlots/ScanFactor; slot++ {
+		slotByteLoc := (slot % numSlots) * ht.slotSize
+		switch ht.ba[slotByteLoc] {
+		case EmptySlot:
+			return 0, false
+		case FullSlot:
+			if bytes.Equal(ht.keyAt(slotByteLoc), kb) {
+				return slotByteLoc, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// put writes slot, the flag, key and value, over the slot of its key or to
+// the first free slot. A tombstone on the way is reused.
+func (ht *HashTable[K, V]) put(slot []byte) error {
+	kb := slot[1 : 1+ht.keys.Size()]
+	if loc, found := ht.find(kb); found {
+		copy(ht.ba[loc:], slot)
+		return nil
+	}
+	numSlots := ht.numSlots()
+	s := ht.hash(kb) % numSlots
+	for firstSlot := s; s-firstSlot <= numSlots/ScanFactor; s++ {
+		slotByteLoc := (s % numSlots) * ht.slotSize
+		switch ht.ba[slotByteLoc] {
+		case DeletedSlot:
+			copy(ht.ba[slotByteLoc:], slot)
+			ht.tombstones -= 1
+			return nil
+		case EmptySlot:
+			if float64(ht.count+1) > MaxLoad*float64(numSlots) {
+				return errors.New("Buffer too full.")
+			}
+			copy(ht.ba[slotByteLoc:], slot)
+			ht.count += 1
+			return nil
+		}
+	}
+	return errors.New("Buffer too full.")
+}
+
+func (ht *HashTable[K, V]) grow() {
+	// as IntHashTable.grow, double unless dropping tombstones frees enough
+	size := uint32(len(ht.ba))
+	if ht.tombstones == 0 || float64(ht.Len()+1) > MaxLoad*float64(ht.numSlots())/2 {
+		size *= 2
+	}
+	nt := *ht
+	nt.ba = make([]byte, size)
+	nt.count, nt.tombstones = 0, 0
+	for loc := uint32(0); loc < uint32(len(ht.ba)); loc += ht.slotSize {
+		if ht.ba[loc] == FullSlot {
+			for nt.put(ht.ba[loc:loc+ht.slotSize]) != nil {
+				nt.grow()
+			}
+		}
+	}
+	*ht = nt
+}
+
+// Put sets the value of k to v.
+func (ht *HashTable[K, V]) Put(k K, v V) error {
+	ht.checkWritable()
+	slot := make([]byte, ht.slotSize)
+	slot[0] = FullSlot
+	if err := ht.keys.Encode(slot[1:], k); err != nil {
+		return err
+	}
+	if err := ht.values.Encode(slot[1+ht.keys.Size():], v); err != nil {
+		return err
+	}
+	for ht.put(slot) != nil {
+		ht.grow()
+	}
+	return nil
+}
+
+// Get returns the value of k and whether k has one.
+func (ht *HashTable[K, V]) Get(k K) (V, bool, error) {
+	var v V
+	kb := make([]byte, ht.keys.Size())
+	if err := ht.keys.Encode(kb, k); err != nil {
+		return v, false, err
+	}
+	loc, found := ht.find(kb)
+	if !found {
+		return v, false, nil
+	}
+	v, err := ht.values.Decode(ht.valueAt(loc))
+	return v, err == nil, err
+}
+
+// Delete removes k and reports whether it was in the table.
+func (ht *HashTable[K, V]) Delete(k K) (bool, error) {
+	ht.checkWritable()
+	kb := make([]byte, ht.keys.Size())
+	if err := ht.keys.Encode(kb, k); err != nil {
+		return false, err
+	}
+	loc, found := ht.find(kb)
+	if found {
+		ht.ba[loc] = DeletedSlot
+		ht.tombstones += 1
+	}
+	return found, nil
+}
+
+// Len returns the number of key value pairs in the table.
+func (ht *HashTable[K, V]) Len() int {
+	return int(ht.count - ht.tombstones)
+}
+
+// ForAll calls f with every pair until a pair fails to decode.
+func (ht *HashTable[K, V]) ForAll(f func(k K, v V)) error {
+	for loc := uint32(0); loc < uint32(len(ht.ba)); loc += ht.slotSize {
+		if ht.ba[loc] != FullSlot {
+			continue
+		}
+		k, err := ht.keys.Decode(ht.keyAt(loc))
+		if err != nil {
+			return err
+		}
+		v, err := ht.values.Decode(ht.valueAt(loc))
+		if err != nil {
+			return err
+		}
+		f(k, v)
+	}
+	return nil
+}
+
+const hashTableMagic = "DSHT"
+const hashTableVersion = 1
+
+// magic, version, slots, count, tombstones, key size, value size, seed
+const hashTableHeaderSize = 32
+
+// AppendBytes appends the header and the buffer of the table to bs, as Save
+// writes them.
+func (ht *HashTable[K, V]) AppendBytes(bs []byte) []byte {
+	start := len(bs)
+	bs = append(bs, make([]byte, hashTableHeaderSize)...)
+	header := bs[start:]
+	copy(header, hashTableMagic)
+	binary.LittleEndian.PutUint32(header[4:], hashTableVersion)
+	binary.LittleEndian.PutUint32(header[8:], ht.numSlots())
+	binary.LittleEndian.PutUint32(header[12:], ht.count)
+	binary.LittleEndian.PutUint32(header[16:], ht.tombstones)
+	binary.LittleEndian.PutUint16(header[20:], uint16(ht.keys.Size()))
+	binary.LittleEndian.PutUint16(header[22:], uint16(ht.values.Size()))
+	binary.LittleEndian.PutUint64(header[24:], uint64(ht.seed))
+	return append(bs, ht.ba...)
+}
+
+// Save writes the table to the file at path, replacing it atomically.
+func (ht *HashTable[K, V]) Save(path string) error {
+	return WriteFileAtomic(path, ht.AppendBytes(nil), 0644)
+}
+
+// HashTableFromBytes returns the table in bs, as returned by AppendBytes. bs
+// is used as is, not copied.
+func HashTableFromBytes[K, V any](keys Codec[K], values Codec[V], bs []byte) (*HashTable[K, V], error) {
+	if len(bs) < hashTableHeaderSize || string(bs[:4]) != hashTableMagic {
+		return nil, errors.New("not a hash table file")
+	}
+	if version := binary.LittleEndian.Uint32(bs[4:]); version != hashTableVersion {
+		return nil, fmt.Errorf("unknown hash table version %d", version)
+	}
+	keySize, valueSize := int(binary.LittleEndian.Uint16(bs[20:])), int(binary.LittleEndian.Uint16(bs[22:]))
+	if keySize != keys.Size() || valueSize != values.Size() {
+		return nil, fmt.Errorf("hash table of %d byte keys and %d byte values", keySize, valueSize)
+	}
+	ht := CreateHashTable(keys, values, 1, int64(binary.LittleEndian.Uint64(bs[24:])))
+	slots := uint64(binary.LittleEndian.Uint32(bs[8:]))
+	ht.count = binary.LittleEndian.Uint32(bs[12:])
+	ht.tombstones = binary.LittleEndian.Uint32(bs[16:])
+	if slots == 0 || uint64(len(bs)) != hashTableHeaderSize+slots*uint64(ht.slotSize) ||
+		uint64(ht.count) > slots || ht.tombstones > ht.count {
+		return nil, errors.New("corrupt hash table file")
+	}
+	ht.ba = bs[hashTableHeaderSize:len(bs):len(bs)]
+	return ht, nil
+}
+
+// OpenHashTable reads the table saved at path, whose keys and values have
+// to be of the sizes of keys and values.
+func OpenHashTable[K, V any](keys Codec[K], values Codec[V], path string) (*HashTable[K, V], error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return HashTableFromBytes(keys, values, bs)
+}
+
+// OpenHashTableReadOnly maps the table saved at path. The table can be read
+// until Close.
+func OpenHashTableReadOnly[K, V any](keys Codec[K], values Codec[V], path string) (*HashTable[K, V], error) {
+	bs, unmap, err := MapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ht, err := HashTableFromBytes(keys, values, bs)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	ht.unmap = unmap
+	return ht, nil
+}
+
+// Close unmaps a table opened read only, the table must not be used after.
+// It does nothing for other tables.
+func (ht *HashTable[K, V]) Close() error {
+	if ht.unmap == nil {
+		return nil
+	}
+	err := ht.unmap()
+	ht.ba, ht.unmap = nil, nil
+	return err
+}
@@ -0,0 +1,128 @@
+package ds
+
+import (
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+type stat struct {
+	mtime  int64
+	size   int64
+	visits uint32
+}
+
+var statCodec = FixedCodec[stat]{
+	Width: 20,
+	Put: func(b []byte, s stat) {
+		binary.LittleEndian.PutUint64(b, uint64(s.mtime))
+		binary.LittleEndian.PutUint64(b[8:], uint64(s.size))
+		binary.LittleEndian.PutUint32(b[16:], s.visits)
+	},
+	Read: func(b []byte) stat {
+		return stat{
+			mtime:  int64(binary.LittleEndian.Uint64(b)),
+			size:   int64(binary.LittleEndian.Uint64(b[8:])),
+			visits: binary.LittleEndian.Uint32(b[16:]),
+		}
+	},
+}
+
+func TestHtPutGetDelete(t *testing.T) {
+	ht := CreateHashTable[uint64, stat](Uint64Codec{}, statCodec, 1, DefaultSeed)
+	for i := uint64(0); i < 1000; i++ {
+		if err := ht.Put(i<<32, stat{int64(i), int64(2 * i), uint32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ht.Put(5<<32, stat{visits: 7})
+	for i := uint64(0); i < 1000; i += 2 {
+		if deleted, err := ht.Delete(i << 32); !deleted || err != nil {
+			t.Errorf("expected %d to be deleted, %v", i<<32, err)
+		}
+	}
+	if ht.Len() != 500 {
+		t.Errorf("expected 500 pairs but got %d", ht.Len())
+	}
+	for i := uint64(0); i < 1000; i++ {
+		s, found, err := ht.Get(i << 32)
+		expected := stat{int64(i), int64(2 * i), uint32(i)}
+		if i == 5 {
+			expected = stat{visits: 7}
+		}
+		if err != nil || found != (i%2 == 1) || (found && s != expected) {
+			t.Errorf("expected %v but got %v, %v, %v", expected, s, found, err)
+		}
+	}
+}
+
+type fakeInterner []string
+
+func (f fakeInterner) GetId(s string) (uint32, error) {
+	for id, str := range f {
+		if str == s {
+			return uint32(id), nil
+		}
+	}
+	return 0, errors.New("not found")
+}
+
+func (f fakeInterner) StrAt(id uint32) (string, error) {
+	if int(id) >= len(f) {
+		return "", errors.New("no such id")
+	}
+	return f[id], nil
+}
+
+func TestHtInternedKeys(t *testing.T) {
+	paths := fakeInterner{"/a", "/b", "/c"}
+	ht := CreateHashTable[string, uint32](InternedStringCodec{paths}, Uint32Codec{}, 4, DefaultSeed)
+	for i, path := range paths {
+		ht.Put(path, uint32(i)*10)
+	}
+	if err := ht.Put("/d", 1); err == nil {
+		t.Error("expected a string without an id to be an error")
+	}
+	seen := map[string]uint32{}
+	if err := ht.ForAll(func(k string, v uint32) { seen[k] = v }); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 3 || seen["/b"] != 10 || seen["/c"] != 20 {
+		t.Errorf("unexpected pairs %v", seen)
+	}
+}
+
+func TestHtSaveOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "table")
+	ht := CreateHashTable[uint64, stat](Uint64Codec{}, statCodec, 1, 9)
+	for i := uint64(0); i < 100; i++ {
+		ht.Put(i, stat{size: int64(i)})
+	}
+	ht.Delete(3)
+	if err := ht.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	opened, err := OpenHashTable[uint64, stat](Uint64Codec{}, statCodec, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped, err := OpenHashTableReadOnly[uint64, stat](Uint64Codec{}, statCodec, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mapped.Close()
+	for _, table := range []*HashTable[uint64, stat]{opened, mapped} {
+		if table.Len() != 99 {
+			t.Errorf("expected 99 pairs but got %d", table.Len())
+		}
+		for i := uint64(0); i < 100; i++ {
+			if s, found, _ := table.Get(i); found != (i != 3) || (found && s.size != int64(i)) {
+				t.Errorf("expected size %d but got %v, %v", i, s, found)
+			}
+		}
+	}
+	if _, err := OpenHashTable[uint64, uint32](Uint64Codec{}, Uint32Codec{}, path); err == nil {
+		t.Error("expected a table of other value sizes to be an error")
+	}
+}
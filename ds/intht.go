@@ -2,14 +2,33 @@ package ds
 
 // todo use tabulation hashing
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"sync"
 )
 
 /*
  Int hash table is an uint32 -> uint32 hashtable based on open addressing and
  linear probing. The buffer of the table grows as needed.
+
+ Put keeps a single value per key, Add allows a key more than once for use as
+ a multimap, e.g. from hashes to whatever has that hash. The buffer is all
+ there is to a table, Bytes and IntHashTableFromBytes save and restore it.
+
+ Save writes the buffer to a file after a header with the capacity, the
+ counts and the seed of the hash. OpenIntHashTable reads the file back,
+ OpenIntHashTableReadOnly maps it instead so that a large table costs no
+ more than the pages looked at. A mapped table can't be written to, Put, Add
+ and the deletes panic on it.
+
+ Deleting marks the slot as a tombstone rather than emptying it, an empty
+ slot ends a probe and would cut off the keys placed after it. Probes go past
+ tombstones and inserts reuse them. Tombstones take up slots as much as live
+ pairs, so both count towards the load that makes the table grow, and
+ growing drops them.
 */
 
 const SlotSize = 9 // flag + key + value
@@ -18,39 +37,98 @@ const SlotSize = 9 // flag + key + value
 // we should resize.
 const ScanFactor = 10
 
+// The table is resized once live pairs and tombstones take up more than this
+// fraction of the slots.
+const MaxLoad = 0.75
+
 const EmptySlot = 0x00
 const FullSlot = 0x01
+const DeletedSlot = 0x02
+
+// DefaultSeed seeds the hash of tables created without one.
+const DefaultSeed = 31
 
 type IntHashTable struct {
 	ba []byte
+	// live pairs and tombstones
+	count      uint32
+	tombstones uint32
+	seed       int64
+	// tabulation tables of seed, nil for DefaultSeed
+	tab *[4][256]int
+	// set for a table mapped from a file
+	unmap func() error
 }
 
-var tabHashTables [4][256]int
+var tabHashTables = newTabHashTables(DefaultSeed)
+
+var seededTabHashTables = struct {
+	sync.Mutex
+	m map[int64]*[4][256]int
+}{m: map[int64]*[4][256]int{}}
 
-func init() {
-	rand.Seed(31)
+func newTabHashTables(seed int64) *[4][256]int {
+	// seeded, tables written to disk have to hash the same when read back
+	var tab [4][256]int
+	r := rand.New(rand.NewSource(seed))
 	for i := 0; i < 4; i++ {
 		for j := 0; j < 256; j++ {
-			tabHashTables[i][j] = rand.Int()
+			tab[i][j] = r.Int()
 		}
 	}
+	return &tab
+}
+
+// tabHashTablesOf returns the tables of seed, shared by all tables with the
+// same seed.
+func tabHashTablesOf(seed int64) *[4][256]int {
+	if seed == DefaultSeed {
+		return nil
+	}
+	seededTabHashTables.Lock()
+	defer seededTabHashTables.Unlock()
+	tab, ok := seededTabHashTables.m[seed]
+	if !ok {
+		tab = newTabHashTables(seed)
+		seededTabHashTables.m[seed] = tab
+	}
+	return tab
 }
 
 // @param initialCapacity initial capacity for storing number of key value pairs
 func CreateIntHashTable(initialCapacity uint32) IntHashTable {
-	iht := IntHashTable{}
+	return CreateIntHashTableWithSeed(initialCapacity, DefaultSeed)
+}
+
+// CreateIntHashTableWithSeed is CreateIntHashTable with the hash seeded by
+// seed.
+func CreateIntHashTableWithSeed(initialCapacity uint32, seed int64) IntHashTable {
+	if initialCapacity == 0 {
+		initialCapacity = 1
+	}
+	iht := IntHashTable{seed: seed, tab: tabHashTablesOf(seed)}
 	iht.ba = make([]byte, initialCapacity*SlotSize)
 	return iht
 }
 
-func hash(k uint32) uint32 {
-	h := tabHashTables[0][k&0x000000FF] ^
-		tabHashTables[1][(k>>8)&0x000000FF] ^
-		tabHashTables[2][(k>>16)&0x000000FF] ^
-		tabHashTables[3][(k>>24)&0x000000FF]
+func (iht *IntHashTable) hash(k uint32) uint32 {
+	tab := iht.tab
+	if tab == nil {
+		tab = tabHashTables
+	}
+	h := tab[0][k&0x000000FF] ^
+		tab[1][(k>>8)&0x000000FF] ^
+		tab[2][(k>>16)&0x000000FF] ^
+		tab[3][(k>>24)&0x000000FF]
 	return uint32(h)
 }
 
+func (iht *IntHashTable) checkWritable() {
+	if iht.unmap != nil {
+		panic("ds: write to a read only hash table")
+	}
+}
+
 // Simply write th 9 bytes to byte buffer starting at slot location
 func writeKV(buffer []byte, k, v, loc uint32) {
 	buffer[loc] = FullSlot
@@ -58,30 +136,56 @@ func writeKV(buffer []byte, k, v, loc uint32) {
 	PutUInt32(buffer, loc+5, v)
 }
 
-func put(buffer []byte, k, v uint32) error {
-	numSlots := uint32(cap(buffer) / SlotSize)
-	h := hash(k)
+func (iht *IntHashTable) numSlots() uint32 {
+	return uint32(cap(iht.ba) / SlotSize)
+}
+
+// put writes k and v to the first free slot, or over the value of k unless
+// dup is set. A tombstone on the way is reused unless k turns up after it.
+func (iht *IntHashTable) put(k, v uint32, dup bool) error {
+	buffer := iht.ba
+	numSlots := iht.numSlots()
+	h := iht.hash(k)
 	slot := h % numSlots
 	slotByteLoc := slot * SlotSize
 	firstSlot := slot
+	tombstone, foundTombstone := uint32(0), false
 	for buffer[slotByteLoc] != EmptySlot {
-		// explicit check in case we add another state for slot in future
-		if buffer[slotByteLoc] == FullSlot {
+		if buffer[slotByteLoc] == DeletedSlot && !foundTombstone {
+			tombstone, foundTombstone = slotByteLoc, true
+			if dup {
+				break
+			}
+		}
+		if buffer[slotByteLoc] == FullSlot && !dup {
 			readKey := ReadUInt32(buffer, slotByteLoc+1)
 			if readKey == k {
 				// key already exists just overwrite it
-				break
+				writeKV(buffer, k, v, slotByteLoc)
+				return nil
 			}
 		}
 		slot += 1
 		// slot is monotonically increasing
 		if slot-firstSlot > numSlots/ScanFactor {
+			if foundTombstone {
+				break
+			}
 			return errors.New("Buffer too full.")
 		}
 		// slotByteLoc wraps around
 		slotByteLoc = (slot % numSlots) * SlotSize
 	}
+	if foundTombstone {
+		writeKV(buffer, k, v, tombstone)
+		iht.tombstones -= 1
+		return nil
+	}
+	if float64(iht.count+1) > MaxLoad*float64(numSlots) {
+		return errors.New("Buffer too full.")
+	}
 	writeKV(buffer, k, v, slotByteLoc)
+	iht.count += 1
 	return nil
 }
 
@@ -102,7 +206,7 @@ func ReadUInt32(ba []byte, offset uint32) uint32 {
 }
 
 func (iht *IntHashTable) ForAll(f func(k, v uint32)) {
-	numSlots := uint32(cap(iht.ba) / SlotSize)
+	numSlots := iht.numSlots()
 	for slot := uint32(0); slot < numSlots; slot++ {
 		byteLoc := slot * SlotSize
 		if iht.ba[byteLoc] == FullSlot {
@@ -113,54 +217,227 @@ func (iht *IntHashTable) ForAll(f func(k, v uint32)) {
 	}
 }
 
+// Len returns the number of key value pairs in the table.
+func (iht *IntHashTable) Len() int {
+	return int(iht.count - iht.tombstones)
+}
+
 func (iht *IntHashTable) grow() {
-	// double size of buffer and add all key values
+	// double size of buffer unless there are tombstones and dropping them
+	// frees enough, and add all key values. A table without tombstones always
+	// doubles, a probe can run too long even when it is far from full.
 	fmt.Println("Rehashing...")
-	newBytes := make([]byte, 2*cap(iht.ba))
+	size := cap(iht.ba)
+	if iht.tombstones == 0 || float64(iht.Len()+1) > MaxLoad*float64(iht.numSlots())/2 {
+		size *= 2
+	}
+	nt := IntHashTable{ba: make([]byte, size), seed: iht.seed, tab: iht.tab}
 	inserter := func(k, v uint32) {
-		put(newBytes, k, v)
+		if nt.put(k, v, true) != nil {
+			nt.grow()
+			nt.put(k, v, true)
+		}
 	}
 	iht.ForAll(inserter)
-	iht.ba = newBytes
+	*iht = nt
 }
 
 func (iht *IntHashTable) Put(k, v uint32) {
-	e := put(iht.ba, k, v)
+	iht.checkWritable()
+	e := iht.put(k, v, false)
 	if e != nil {
 		iht.grow()
 		iht.Put(k, v)
 	}
 }
 
-func (iht *IntHashTable) Get(k uint32) (uint32, bool) {
-	numSlots := uint32(cap(iht.ba) / SlotSize)
-	h := hash(k)
-	slot := h % numSlots
-	slotByteLoc := slot * SlotSize
-	firstSlot := slot
-	for {
-		// slotByteLoc wraps around
-		slotByteLoc = (slot % numSlots) * SlotSize
-		if iht.ba[slotByteLoc] == FullSlot {
-			readKey := ReadUInt32(iht.ba, slotByteLoc+1)
-			if readKey == k {
-				v := ReadUInt32(iht.ba, slotByteLoc+5)
-				return v, true
-			} else {
-				// slot is monotonically increasing
-				slot += 1
-				if slot-firstSlot > numSlots/ScanFactor {
-					panic(errors.New("Read scanned more than expected items, this should never happen."))
-				}
+// Add puts k and v without replacing the values k already has.
+func (iht *IntHashTable) Add(k, v uint32) {
+	iht.checkWritable()
+	e := iht.put(k, v, true)
+	if e != nil {
+		iht.grow()
+		iht.Add(k, v)
+	}
+}
+
+// probe calls f with the location of every full slot that may hold k until f
+// returns false.
+func (iht *IntHashTable) probe(k uint32, f func(slotByteLoc uint32) bool) {
+	numSlots := iht.numSlots()
+	slot := iht.hash(k) % numSlots
+	for firstSlot := slot; slot-firstSlot <= numSlots/ScanFactor; slot++ {
+		slotByteLoc := (slot % numSlots) * SlotSize
+		switch iht.ba[slotByteLoc] {
+		case EmptySlot:
+			return
+		case FullSlot:
+			if ReadUInt32(iht.ba, slotByteLoc+1) == k && !f(slotByteLoc) {
+				return
 			}
-		} else {
-			return 0, false
 		}
 	}
 }
 
-// note that this does not provide a copy, this is unsafe but exposed for
-// performance reasons.
-func (iht *IntHashTable) bytes() []byte {
+func (iht *IntHashTable) Get(k uint32) (uint32, bool) {
+	v, found := uint32(0), false
+	iht.probe(k, func(slotByteLoc uint32) bool {
+		v, found = ReadUInt32(iht.ba, slotByteLoc+5), true
+		return false
+	})
+	return v, found
+}
+
+// GetAll calls f with every value of k until f returns false.
+func (iht *IntHashTable) GetAll(k uint32, f func(v uint32) bool) {
+	iht.probe(k, func(slotByteLoc uint32) bool {
+		return f(ReadUInt32(iht.ba, slotByteLoc+5))
+	})
+}
+
+// Delete removes every value of k and reports whether there was one.
+func (iht *IntHashTable) Delete(k uint32) bool {
+	iht.checkWritable()
+	deleted := false
+	iht.probe(k, func(slotByteLoc uint32) bool {
+		iht.ba[slotByteLoc] = DeletedSlot
+		iht.tombstones += 1
+		deleted = true
+		return true
+	})
+	return deleted
+}
+
+// DeleteValue removes the pair of k and v, one of them if it was added more
+// than once, and reports whether there was one.
+func (iht *IntHashTable) DeleteValue(k, v uint32) bool {
+	iht.checkWritable()
+	deleted := false
+	iht.probe(k, func(slotByteLoc uint32) bool {
+		if ReadUInt32(iht.ba, slotByteLoc+5) != v {
+			return true
+		}
+		iht.ba[slotByteLoc] = DeletedSlot
+		iht.tombstones += 1
+		deleted = true
+		return false
+	})
+	return deleted
+}
+
+// Bytes returns the buffer of the table. Note that this does not provide a
+// copy, this is unsafe but exposed for performance reasons.
+func (iht *IntHashTable) Bytes() []byte {
 	return iht.ba
 }
+
+// IntHashTableFromBytes returns the table with the buffer ba, as returned by
+// Bytes. ba is used as is, not copied. The table hashes with DefaultSeed.
+func IntHashTableFromBytes(ba []byte) (IntHashTable, error) {
+	if len(ba) == 0 || len(ba)%SlotSize != 0 {
+		return IntHashTable{}, errors.New("not a hash table buffer")
+	}
+	iht := IntHashTable{ba: ba[:len(ba):len(ba)], seed: DefaultSeed}
+	for loc := 0; loc < len(ba); loc += SlotSize {
+		switch ba[loc] {
+		case EmptySlot:
+		case FullSlot:
+			iht.count += 1
+		case DeletedSlot:
+			iht.count += 1
+			iht.tombstones += 1
+		default:
+			return IntHashTable{}, errors.New("not a hash table buffer")
+		}
+	}
+	return iht, nil
+}
+
+const intHashTableMagic = "DSIH"
+const intHashTableVersion = 1
+
+// magic, version, slots, count, tombstones, unused, seed
+const IntHashTableHeaderSize = 32
+
+// appendEncoded appends the header and the buffer of the table to bs.
+func (iht *IntHashTable) appendEncoded(bs []byte) []byte {
+	var header [IntHashTableHeaderSize]byte
+	copy(header[:], intHashTableMagic)
+	binary.LittleEndian.PutUint32(header[4:], intHashTableVersion)
+	binary.LittleEndian.PutUint32(header[8:], iht.numSlots())
+	binary.LittleEndian.PutUint32(header[12:], iht.count)
+	binary.LittleEndian.PutUint32(header[16:], iht.tombstones)
+	binary.LittleEndian.PutUint64(header[24:], uint64(iht.seed))
+	bs = append(bs, header[:]...)
+	return append(bs, iht.ba...)
+}
+
+// decodeIntHashTable returns the table encoded at the start of bs and the
+// number of bytes it takes. The buffer of the table is bs itself.
+func decodeIntHashTable(bs []byte) (IntHashTable, int, error) {
+	if len(bs) < IntHashTableHeaderSize || string(bs[:4]) != intHashTableMagic {
+		return IntHashTable{}, 0, errors.New("not a hash table file")
+	}
+	if version := binary.LittleEndian.Uint32(bs[4:]); version != intHashTableVersion {
+		return IntHashTable{}, 0, fmt.Errorf("unknown hash table version %d", version)
+	}
+	slots := uint64(binary.LittleEndian.Uint32(bs[8:]))
+	count := binary.LittleEndian.Uint32(bs[12:])
+	tombstones := binary.LittleEndian.Uint32(bs[16:])
+	seed := int64(binary.LittleEndian.Uint64(bs[24:]))
+	size := IntHashTableHeaderSize + slots*SlotSize
+	if slots == 0 || uint64(len(bs)) < size || uint64(count) > slots || tombstones > count {
+		return IntHashTable{}, 0, errors.New("corrupt hash table file")
+	}
+	ba := bs[IntHashTableHeaderSize:size:size]
+	iht := IntHashTable{ba: ba, count: count, tombstones: tombstones, seed: seed, tab: tabHashTablesOf(seed)}
+	return iht, int(size), nil
+}
+
+// Save writes the table to the file at path, replacing it atomically.
+func (iht *IntHashTable) Save(path string) error {
+	return WriteFileAtomic(path, iht.appendEncoded(nil), 0644)
+}
+
+// OpenIntHashTable reads the table saved at path.
+func OpenIntHashTable(path string) (IntHashTable, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return IntHashTable{}, err
+	}
+	iht, size, err := decodeIntHashTable(bs)
+	if err == nil && size != len(bs) {
+		err = errors.New("trailing bytes after hash table")
+	}
+	return iht, err
+}
+
+// OpenIntHashTableReadOnly maps the table saved at path. The table can be
+// read until Close.
+func OpenIntHashTableReadOnly(path string) (IntHashTable, error) {
+	bs, unmap, err := MapFile(path)
+	if err != nil {
+		return IntHashTable{}, err
+	}
+	iht, size, err := decodeIntHashTable(bs)
+	if err == nil && size != len(bs) {
+		err = errors.New("trailing bytes after hash table")
+	}
+	if err != nil {
+		unmap()
+		return IntHashTable{}, err
+	}
+	iht.unmap = unmap
+	return iht, nil
+}
+
+// Close unmaps a table opened read only, the table must not be used after.
+// It does nothing for other tables.
+func (iht *IntHashTable) Close() error {
+	if iht.unmap == nil {
+		return nil
+	}
+	err := iht.unmap()
+	*iht = IntHashTable{}
+	return err
+}
@@ -1,6 +1,8 @@
 package ds
 
 import (
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 )
 
@@ -51,3 +53,195 @@ func TestIhtOvewrite(t *testing.T) {
 		t.Errorf("expected %d but got %d", 3, v)
 	}
 }
+
+func TestIhtAddDuplicates(t *testing.T) {
+	iht := CreateIntHashTable(1)
+	for i := uint32(0); i < 100; i++ {
+		iht.Add(i%10, i)
+	}
+	for k := uint32(0); k < 10; k++ {
+		seen := 0
+		iht.GetAll(k, func(v uint32) bool {
+			if v%10 != k {
+				t.Errorf("unexpected value %d for %d", v, k)
+			}
+			seen++
+			return true
+		})
+		if seen != 10 {
+			t.Errorf("expected 10 values for %d but got %d", k, seen)
+		}
+	}
+	stopped := 0
+	iht.GetAll(3, func(v uint32) bool {
+		stopped++
+		return false
+	})
+	if stopped != 1 {
+		t.Errorf("expected GetAll to stop after 1 value but got %d", stopped)
+	}
+}
+
+func TestIhtFromBytes(t *testing.T) {
+	iht := CreateIntHashTable(1)
+	for i := uint32(0); i < 100; i++ {
+		iht.Put(i, 2*i)
+	}
+	restored, err := IntHashTableFromBytes(append([]byte(nil), iht.Bytes()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(0); i < 100; i++ {
+		if v, found := restored.Get(i); !found || v != 2*i {
+			t.Errorf("expected %d but got %d, %v", 2*i, v, found)
+		}
+	}
+	if _, err := IntHashTableFromBytes(make([]byte, SlotSize+1)); err == nil {
+		t.Error("expected a buffer of partial slots to be an error")
+	}
+}
+
+func TestIhtDelete(t *testing.T) {
+	iht := CreateIntHashTable(16)
+	for i := uint32(0); i < 10; i++ {
+		iht.Put(i, 2*i)
+	}
+	for i := uint32(0); i < 10; i += 2 {
+		if !iht.Delete(i) {
+			t.Errorf("expected %d to be deleted", i)
+		}
+	}
+	if iht.Delete(0) {
+		t.Error("deleted 0 twice")
+	}
+	if iht.Len() != 5 {
+		t.Errorf("expected 5 pairs but got %d", iht.Len())
+	}
+	// keys placed after a tombstone must still be found
+	for i := uint32(0); i < 10; i++ {
+		v, found := iht.Get(i)
+		if found != (i%2 == 1) || (found && v != 2*i) {
+			t.Errorf("%d: unexpected %d, %v", i, v, found)
+		}
+	}
+	iht.ForAll(func(k, v uint32) {
+		if k%2 == 0 {
+			t.Errorf("ForAll returned deleted key %d", k)
+		}
+	})
+	iht.Put(4, 1)
+	if v, found := iht.Get(4); !found || v != 1 {
+		t.Errorf("expected 1 but got %d, %v", v, found)
+	}
+}
+
+func TestIhtDeleteValue(t *testing.T) {
+	iht := CreateIntHashTable(1)
+	iht.Add(1, 10)
+	iht.Add(1, 11)
+	iht.Add(1, 10)
+	if !iht.DeleteValue(1, 10) || iht.DeleteValue(1, 12) {
+		t.Error("unexpected DeleteValue result")
+	}
+	values := make([]uint32, 0)
+	iht.GetAll(1, func(v uint32) bool {
+		values = append(values, v)
+		return true
+	})
+	if len(values) != 2 {
+		t.Errorf("expected 2 values left but got %v", values)
+	}
+}
+
+func TestIhtGrowPurgesTombstones(t *testing.T) {
+	iht := CreateIntHashTable(64)
+	capacity := len(iht.Bytes())
+	// churn through many more keys than fit, only a few live at once
+	for i := uint32(0); i < 10000; i++ {
+		iht.Put(i, i)
+		if i >= 4 {
+			iht.Delete(i - 4)
+		}
+	}
+	if iht.Len() != 4 {
+		t.Errorf("expected 4 pairs but got %d", iht.Len())
+	}
+	if len(iht.Bytes()) != capacity {
+		t.Errorf("expected the table to stay at %d bytes but got %d", capacity, len(iht.Bytes()))
+	}
+	for i := uint32(9996); i < 10000; i++ {
+		if v, found := iht.Get(i); !found || v != i {
+			t.Errorf("expected %d but got %d, %v", i, v, found)
+		}
+	}
+	restored, err := IntHashTableFromBytes(iht.Bytes())
+	if err != nil || restored.Len() != 4 {
+		t.Errorf("expected 4 pairs restored but got %d, %v", restored.Len(), err)
+	}
+}
+
+func TestIhtSaveOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "table")
+	iht := CreateIntHashTableWithSeed(1, 7)
+	for i := uint32(0); i < 100; i++ {
+		iht.Put(i, 2*i)
+	}
+	iht.Delete(50)
+	if err := iht.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	opened, err := OpenIntHashTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped, err := OpenIntHashTableReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mapped.Close()
+	for _, table := range []*IntHashTable{&opened, &mapped} {
+		if table.Len() != 99 || table.seed != 7 {
+			t.Errorf("expected 99 pairs with seed 7 but got %d with %d", table.Len(), table.seed)
+		}
+		for i := uint32(0); i < 100; i++ {
+			if v, found := table.Get(i); found != (i != 50) || (found && v != 2*i) {
+				t.Errorf("expected %d but got %d, %v", 2*i, v, found)
+			}
+		}
+	}
+	opened.Put(50, 3)
+	if v, found := opened.Get(50); !found || v != 3 {
+		t.Errorf("expected 3 but got %d, %v", v, found)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a write to a mapped table to panic")
+		}
+	}()
+	mapped.Put(50, 3)
+}
+
+func TestIhtOpenCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	iht := CreateIntHashTable(10)
+	iht.Put(1, 2)
+	bs := iht.appendEncoded(nil)
+	cases := map[string][]byte{
+		"empty":     nil,
+		"truncated": bs[:len(bs)-1],
+		"trailing":  append(append([]byte(nil), bs...), 0),
+		"headless":  bs[IntHashTableHeaderSize:],
+	}
+	for name, bs := range cases {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, bs, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenIntHashTable(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if _, err := OpenIntHashTableReadOnly(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package ds
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
 )
 
 /*
@@ -10,43 +13,236 @@ This is a hash table where key are uint32 but values are any byte array.
 The value is stored in a write ahead log and offset stored in a hashtable, thus
 providing random access to value while keeping memory usage organized in a
 serialization friendly way.
+
+Every value is a record of its capacity, its length and capacity bytes. A
+value that fits the record of the old value of its key overwrites it, a
+longer one goes to a new record at the end. Records no key points to any
+more and the unused bytes of the others are dead, Size tells how many there
+are and Compact rewrites the buffer without them.
+
+Save writes a header, the inner table as IntHashTable.Save would and then the
+log of values. OpenIntKeyHashTableReadOnly maps the file, values are then
+read from the mapped pages and the table can't be written to.
 */
 
 type IntKeyHashTable struct {
 	innerHT IntHashTable
-	// We could use a file here but let's start with a buffer for now
-	buf *bytes.Buffer
+	// records of values, offsets of records are in innerHT
+	buf []byte
+	// bytes of buf Compact would drop
+	dead uint64
+	// set for a table mapped from a file
+	unmap func() error
 }
 
 func CreateIntKeyHashTable() *IntKeyHashTable {
 	ht := IntKeyHashTable{}
 	ht.innerHT = CreateIntHashTable(1024)
-	ht.buf = bytes.NewBuffer(make([]byte, 1024*4))
+	ht.buf = make([]byte, 0, 1024*4)
 	return &ht
 }
 
-func (ht *IntKeyHashTable) Put(k uint32, v []byte) {
-	// but in buffer get offset, store offset in inner ht
-	offset := uint32(ht.buf.Len())
-	// write length then write bytes
-	valueLen := uint32(len(v))
-	valueLenBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(valueLenBytes, valueLen)
-	ht.buf.Write(valueLenBytes)
-	ht.buf.Write(v)
+// capacity, length
+const recordHeaderSize = 8
+
+// record returns the capacity and length of the record at offset.
+func (ht *IntKeyHashTable) record(offset uint32) (capacity, length uint32, err error) {
+	if uint64(offset)+recordHeaderSize > uint64(len(ht.buf)) {
+		return 0, 0, fmt.Errorf("value at %d past the end of %d bytes", offset, len(ht.buf))
+	}
+	capacity = binary.LittleEndian.Uint32(ht.buf[offset:])
+	length = binary.LittleEndian.Uint32(ht.buf[offset+4:])
+	if length > capacity || uint64(offset)+recordHeaderSize+uint64(capacity) > uint64(len(ht.buf)) {
+		return 0, 0, fmt.Errorf("truncated value at %d", offset)
+	}
+	return capacity, length, nil
+}
+
+// appendRecord appends a record of v without spare capacity to buf.
+func appendRecord(buf []byte, v []byte) []byte {
+	var header [recordHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[:], uint32(len(v)))
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(v)))
+	return append(append(buf, header[:]...), v...)
+}
+
+func (ht *IntKeyHashTable) Put(k uint32, v []byte) error {
+	if ht.unmap != nil {
+		panic("ds: write to a read only hash table")
+	}
+	abandoned := uint64(0)
+	if offset, found := ht.innerHT.Get(k); found {
+		capacity, length, err := ht.record(offset)
+		if err != nil {
+			return err
+		}
+		if uint64(len(v)) <= uint64(capacity) {
+			binary.LittleEndian.PutUint32(ht.buf[offset+4:], uint32(len(v)))
+			copy(ht.buf[offset+recordHeaderSize:], v)
+			ht.dead = ht.dead + uint64(length) - uint64(len(v))
+			return nil
+		}
+		// the spare capacity is dead already
+		abandoned = recordHeaderSize + uint64(length)
+	}
+	// offsets are uint32
+	if uint64(len(ht.buf))+recordHeaderSize+uint64(len(v)) > math.MaxUint32 {
+		return errors.New("value buffer full")
+	}
+	offset := uint32(len(ht.buf))
+	ht.buf = appendRecord(ht.buf, v)
 	ht.innerHT.Put(k, offset)
+	ht.dead += abandoned
+	return nil
 }
 
-func (ht *IntKeyHashTable) Get(k uint32) ([]byte, bool) {
+// Get returns the value of k and whether k has one.
+func (ht *IntKeyHashTable) Get(k uint32) ([]byte, bool, error) {
 	offset, found := ht.innerHT.Get(k)
 	if !found {
-		return nil, false
-	}
-	valueLenBytes := make([]byte, 4)
-	bufAtOffset := bytes.NewBuffer(ht.buf.Bytes()[offset:])
-	bufAtOffset.Read(valueLenBytes) // todo: handle error
-	valueLen := binary.LittleEndian.Uint32(valueLenBytes)
-	valueBytes := make([]byte, valueLen)
-	bufAtOffset.Read(valueBytes) // todo handle error
-	return valueBytes, true
+		return nil, false, nil
+	}
+	_, length, err := ht.record(offset)
+	if err != nil {
+		return nil, false, err
+	}
+	start := offset + recordHeaderSize
+	// copied, the buffer may be a mapping that goes away on Close
+	return append([]byte(nil), ht.buf[start:start+length]...), true, nil
+}
+
+// Delete removes k and reports whether it was in the table.
+func (ht *IntKeyHashTable) Delete(k uint32) (bool, error) {
+	if ht.unmap != nil {
+		panic("ds: write to a read only hash table")
+	}
+	offset, found := ht.innerHT.Get(k)
+	if !found {
+		return false, nil
+	}
+	_, length, err := ht.record(offset)
+	if err != nil {
+		return false, err
+	}
+	ht.innerHT.Delete(k)
+	ht.dead += recordHeaderSize + uint64(length)
+	return true, nil
+}
+
+// Len returns the number of keys in the table.
+func (ht *IntKeyHashTable) Len() int {
+	return ht.innerHT.Len()
+}
+
+// Size returns the size of the buffer of values and how many of its bytes
+// are dead, which Compact would reclaim.
+func (ht *IntKeyHashTable) Size() (size, dead int64) {
+	return int64(len(ht.buf)), int64(ht.dead)
+}
+
+// Compact rewrites the buffer with only the live values, each in a record
+// without spare capacity.
+func (ht *IntKeyHashTable) Compact() error {
+	if ht.unmap != nil {
+		panic("ds: write to a read only hash table")
+	}
+	buf := make([]byte, 0, uint64(len(ht.buf))-ht.dead)
+	var moved [][2]uint32
+	var err error
+	ht.innerHT.ForAll(func(k, offset uint32) {
+		_, length, e := ht.record(offset)
+		if e != nil {
+			err = e
+			return
+		}
+		start := offset + recordHeaderSize
+		moved = append(moved, [2]uint32{k, uint32(len(buf))})
+		buf = appendRecord(buf, ht.buf[start:start+length])
+	})
+	if err != nil {
+		return err
+	}
+	// keys are in the table already, their offsets are overwritten in place
+	for _, kv := range moved {
+		ht.innerHT.Put(kv[0], kv[1])
+	}
+	ht.buf, ht.dead = buf, 0
+	return nil
+}
+
+const intKeyHashTableMagic = "DSIK"
+const intKeyHashTableVersion = 2
+
+// magic, version, length of values, dead bytes of values
+const intKeyHashTableHeaderSize = 16
+
+// Save writes the table to the file at path, replacing it atomically.
+func (ht *IntKeyHashTable) Save(path string) error {
+	bs := make([]byte, intKeyHashTableHeaderSize, intKeyHashTableHeaderSize+
+		IntHashTableHeaderSize+len(ht.innerHT.ba)+len(ht.buf))
+	copy(bs, intKeyHashTableMagic)
+	binary.LittleEndian.PutUint32(bs[4:], intKeyHashTableVersion)
+	binary.LittleEndian.PutUint32(bs[8:], uint32(len(ht.buf)))
+	binary.LittleEndian.PutUint32(bs[12:], uint32(ht.dead))
+	bs = ht.innerHT.appendEncoded(bs)
+	bs = append(bs, ht.buf...)
+	return WriteFileAtomic(path, bs, 0644)
+}
+
+func decodeIntKeyHashTable(bs []byte) (*IntKeyHashTable, error) {
+	if len(bs) < intKeyHashTableHeaderSize || string(bs[:4]) != intKeyHashTableMagic {
+		return nil, errors.New("not a hash table file")
+	}
+	if version := binary.LittleEndian.Uint32(bs[4:]); version != intKeyHashTableVersion {
+		return nil, fmt.Errorf("unknown hash table version %d", version)
+	}
+	valuesLen := uint64(binary.LittleEndian.Uint32(bs[8:]))
+	dead := uint64(binary.LittleEndian.Uint32(bs[12:]))
+	inner, size, err := decodeIntHashTable(bs[intKeyHashTableHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+	values := bs[intKeyHashTableHeaderSize+size:]
+	if uint64(len(values)) != valuesLen || dead > valuesLen {
+		return nil, errors.New("corrupt hash table file")
+	}
+	return &IntKeyHashTable{innerHT: inner, buf: values[:len(values):len(values)], dead: dead}, nil
+}
+
+// OpenIntKeyHashTable reads the table saved at path.
+func OpenIntKeyHashTable(path string) (*IntKeyHashTable, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeIntKeyHashTable(bs)
+}
+
+// OpenIntKeyHashTableReadOnly maps the table saved at path. The table can be
+// read until Close.
+func OpenIntKeyHashTableReadOnly(path string) (*IntKeyHashTable, error) {
+	bs, unmap, err := MapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ht, err := decodeIntKeyHashTable(bs)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	ht.unmap = unmap
+	// the inner table panics on writes too
+	ht.innerHT.unmap = func() error { return nil }
+	return ht, nil
+}
+
+// Close unmaps a table opened read only, the table must not be used after.
+// It does nothing for other tables.
+func (ht *IntKeyHashTable) Close() error {
+	if ht.unmap == nil {
+		return nil
+	}
+	err := ht.unmap()
+	*ht = IntKeyHashTable{}
+	return err
 }
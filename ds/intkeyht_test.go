@@ -2,6 +2,7 @@ package ds
 
 import (
 	"fmt"
+	"path/filepath"
 	"testing"
 )
 
@@ -12,8 +13,8 @@ func TestIKhtPutGet(t *testing.T) {
 		iht.Put(i, []byte(fmt.Sprintf("some %d", i)))
 	}
 	for i := uint32(0); i < numItems; i++ {
-		v, found := iht.Get(i)
-		if !found {
+		v, found, err := iht.Get(i)
+		if !found || err != nil {
 			t.Error("value not found")
 		}
 		if string(v) != fmt.Sprintf("some %d", i) {
@@ -22,4 +23,88 @@ func TestIKhtPutGet(t *testing.T) {
 	}
 }
 
+func TestIKhtSaveOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "table")
+	iht := CreateIntKeyHashTable()
+	for i := uint32(0); i < 100; i++ {
+		iht.Put(i, []byte(fmt.Sprintf("some %d", i)))
+	}
+	if err := iht.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	opened, err := OpenIntKeyHashTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped, err := OpenIntKeyHashTableReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []*IntKeyHashTable{opened, mapped} {
+		for i := uint32(0); i < 100; i++ {
+			if v, found, _ := table.Get(i); !found || string(v) != fmt.Sprintf("some %d", i) {
+				t.Errorf("expected some %d but got %s, %v", i, v, found)
+			}
+		}
+	}
+	v, _, _ := mapped.Get(1)
+	if err := mapped.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "some 1" {
+		t.Errorf("expected a value to outlive the mapping but got %s", v)
+	}
+	opened.Put(100, []byte("more"))
+	if v, found, _ := opened.Get(100); !found || string(v) != "more" {
+		t.Errorf("expected more but got %s, %v", v, found)
+	}
+}
+
+func TestIKhtOverwriteDeleteCompact(t *testing.T) {
+	iht := CreateIntKeyHashTable()
+	iht.Put(1, []byte("long value"))
+	iht.Put(2, []byte("other"))
+	iht.Put(1, []byte("short"))
+	if size, dead := iht.Size(); size != 2*8+10+5 || dead != 5 {
+		t.Errorf("expected an overwrite in place but got size %d with %d dead", size, dead)
+	}
+	iht.Put(1, []byte("longer value"))
+	if _, dead := iht.Size(); dead != 8+10 {
+		t.Errorf("expected the old record to be dead but got %d dead", dead)
+	}
+	if deleted, err := iht.Delete(2); !deleted || err != nil {
+		t.Errorf("expected 2 to be deleted, %v", err)
+	}
+	if deleted, _ := iht.Delete(2); deleted {
+		t.Error("expected 2 to be deleted once")
+	}
+	if err := iht.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if size, dead := iht.Size(); size != 8+12 || dead != 0 {
+		t.Errorf("expected one record after compacting but got size %d with %d dead", size, dead)
+	}
+	if v, found, err := iht.Get(1); !found || err != nil || string(v) != "longer value" {
+		t.Errorf("expected longer value but got %s, %v, %v", v, found, err)
+	}
+	if _, found, _ := iht.Get(2); found {
+		t.Error("expected 2 to be gone")
+	}
+}
+
+func TestIKhtTruncated(t *testing.T) {
+	iht := CreateIntKeyHashTable()
+	iht.Put(1, []byte("value"))
+	iht.buf = iht.buf[:len(iht.buf)-1]
+	if _, _, err := iht.Get(1); err == nil {
+		t.Error("expected a truncated value to be an error")
+	}
+	if err := iht.Put(1, []byte("v")); err == nil {
+		t.Error("expected overwriting a truncated value to be an error")
+	}
+	if _, err := iht.Delete(1); err == nil {
+		t.Error("expected deleting a truncated value to be an error")
+	}
+}
+
 // todo: add more tests
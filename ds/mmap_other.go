@@ -0,0 +1,14 @@
+//go:build !unix
+
+package ds
+
+import "io/ioutil"
+
+// MapFile reads the whole file, mmap is only used on unix.
+func MapFile(path string) ([]byte, func() error, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bs, func() error { return nil }, nil
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package ds
+
+import (
+	"os"
+	"syscall"
+)
+
+// MapFile maps the file at path read only. The mapping is shared, processes
+// mapping the same file use the same pages.
+func MapFile(path string) ([]byte, func() error, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.Size() == 0 {
+		// mapping nothing fails, there is nothing to map anyway
+		return nil, func() error { return nil }, nil
+	}
+	bs, err := syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bs, func() error { return syscall.Munmap(bs) }, nil
+}
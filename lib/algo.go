@@ -48,9 +48,63 @@ func MergeIndices(idx1, idx2 map[string][]uint32) map[string][]uint32 {
 	newIdx := make(map[string][]uint32)
 	for _, idx := range indices {
 		for trigram, paths := range idx {
-			sort.Sort(UInt32ByValue(paths))
+			// indices may be shared with concurrent readers, never sort them
+			// in place
+			if !sort.IsSorted(UInt32ByValue(paths)) {
+				paths = append([]uint32(nil), paths...)
+				sort.Sort(UInt32ByValue(paths))
+			}
 			newIdx[trigram] = MergeSortedIntArray(paths, newIdx[trigram])
 		}
 	}
 	return newIdx
 }
+
+// UpdateIndex returns a copy of idx with the ids in dead removed from the
+// posting lists of deadTrigrams and with added merged in. Only the touched
+// posting lists are copied, the rest are shared with idx, which makes this
+// cheap enough to run for every small batch of changes.
+func UpdateIndex(idx map[string][]uint32, dead map[uint32]bool, deadTrigrams map[string]bool, added map[string][]uint32) map[string][]uint32 {
+	newIdx := make(map[string][]uint32, len(idx))
+	for trigram, paths := range idx {
+		newIdx[trigram] = paths
+	}
+	for trigram := range deadTrigrams {
+		kept := make([]uint32, 0, len(newIdx[trigram]))
+		for _, path := range newIdx[trigram] {
+			if !dead[path] {
+				kept = append(kept, path)
+			}
+		}
+		if len(kept) > 0 {
+			newIdx[trigram] = kept
+		} else {
+			delete(newIdx, trigram)
+		}
+	}
+	for trigram, paths := range added {
+		paths = append([]uint32(nil), paths...)
+		sort.Sort(UInt32ByValue(paths))
+		newIdx[trigram] = MergeSortedIntArray(paths, newIdx[trigram])
+	}
+	return newIdx
+}
+
+// RemapIds returns a copy of idx with every id replaced by the one remap maps
+// it to. Ids remap does not have are dropped, as are trigrams left without any
+// path. remap has to preserve the order of ids for the lists to stay sorted.
+func RemapIds(idx map[string][]uint32, remap map[uint32]uint32) map[string][]uint32 {
+	newIdx := make(map[string][]uint32)
+	for trigram, paths := range idx {
+		mapped := make([]uint32, 0, len(paths))
+		for _, path := range paths {
+			if id, found := remap[path]; found {
+				mapped = append(mapped, id)
+			}
+		}
+		if len(mapped) > 0 {
+			newIdx[trigram] = mapped
+		}
+	}
+	return newIdx
+}
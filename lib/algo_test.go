@@ -41,4 +41,15 @@ func TestMergedPathsOneEmpty(t *testing.T) {
 	verify([]uint32{1, 2}, []uint32{}, []uint32{1, 2}, t)
 }
 
+func TestRemapIds(t *testing.T) {
+	idx := map[string][]uint32{"abc": {10, 20, 30}, "bcd": {20}}
+	newIdx := RemapIds(idx, map[uint32]uint32{10: 0, 30: 4})
+	if !compareSlices(newIdx["abc"], []uint32{0, 4}) {
+		t.Errorf("Error: %v != %v", newIdx["abc"], []uint32{0, 4})
+	}
+	if _, found := newIdx["bcd"]; found {
+		t.Error("Error: empty posting list kept")
+	}
+}
+
 // todo write tests for mergeIndices
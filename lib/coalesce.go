@@ -0,0 +1,49 @@
+package lib
+
+import "sync"
+
+/*
+coalescer runs a function on behalf of many concurrent callers without ever
+running it twice at the same time. A caller that arrives while a run is in
+progress does not start its own, it waits for one more run which starts after
+the current one finishes and is shared by everybody who arrived meanwhile.
+Every caller therefore returns only after a run that started after its call.
+*/
+type coalescer struct {
+	mu      sync.Mutex
+	running bool
+	// closed once the run following the current one is done
+	next chan struct{}
+}
+
+func (c *coalescer) Do(f func()) {
+	c.mu.Lock()
+	if c.running {
+		if c.next == nil {
+			c.next = make(chan struct{})
+		}
+		next := c.next
+		c.mu.Unlock()
+		<-next
+		return
+	}
+	c.running = true
+	c.mu.Unlock()
+
+	var done chan struct{}
+	for {
+		f()
+		c.mu.Lock()
+		if done != nil {
+			close(done)
+		}
+		done = c.next
+		c.next = nil
+		if done == nil {
+			c.running = false
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,47 @@
+package lib
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescerSharesRuns(t *testing.T) {
+	var c coalescer
+	var running, runs int32
+	gate := make(chan struct{})
+	f := func() {
+		if atomic.AddInt32(&running, 1) != 1 {
+			t.Error("overlapping runs")
+		}
+		if atomic.AddInt32(&runs, 1) == 1 {
+			<-gate
+		}
+		atomic.AddInt32(&running, -1)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.Do(f)
+	}()
+	for atomic.LoadInt32(&runs) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Do(f)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+	// everybody who arrived during the first run shares the second one
+	if n := atomic.LoadInt32(&runs); n != 2 {
+		t.Errorf("expected 2 runs but got %d", n)
+	}
+}
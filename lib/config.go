@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+ Config drives where pathsearch keeps its state and what it indexes. It is
+ read from a json file, by default $XDG_CONFIG_HOME/pathsearch/config.json,
+ and individual fields can then be overridden from the command line.
+
+ State files default to $XDG_DATA_HOME/pathsearch.
+*/
+
+const appName = "pathsearch"
+
+const defaultIndexEvery = 600 * time.Second
+
+type Config struct {
+	IndexPath     string   `json:"index"`
+	StringidsPath string   `json:"stringids"`
+	Roots         []string `json:"roots"`
+	// RootsOverride makes Roots win over the roots added or removed at
+	// runtime, as when they are given on the command line.
+	RootsOverride bool          `json:"-"`
+	IndexEvery    time.Duration `json:"-"`
+	// IndexEverySeconds is how IndexEvery is spelled in the config file.
+	IndexEverySeconds int `json:"index_every_seconds"`
+	// Exclude holds gitignore style patterns applied under every root.
+	Exclude []string `json:"exclude"`
+	// Git makes roots that are git repositories list their files from the
+	// git index, GitUntracked adds the files that are neither tracked nor
+	// ignored.
+	Git          bool `json:"git"`
+	GitUntracked bool `json:"git_untracked"`
+	// WalkWorkers is how many directories are read at once.
+	WalkWorkers int `json:"walk_workers"`
+	// Fsync is when the stringids wal is synced to disk, "always",
+	// "interval" or "never".
+	Fsync string `json:"fsync"`
+}
+
+func xdgDir(env string, fallback ...string) string {
+	if dir := os.Getenv(env); dir != "" {
+		return filepath.Join(dir, appName)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+	parts := append([]string{home}, fallback...)
+	return filepath.Join(append(parts, appName)...)
+}
+
+func DefaultConfigPath() string {
+	return filepath.Join(xdgDir("XDG_CONFIG_HOME", ".config"), "config.json")
+}
+
+func DataDir() string {
+	return xdgDir("XDG_DATA_HOME", ".local", "share")
+}
+
+func DefaultConfig() *Config {
+	dataDir := DataDir()
+	return &Config{
+		IndexPath:     filepath.Join(dataDir, "index"),
+		StringidsPath: filepath.Join(dataDir, "stringids"),
+		Roots:         make([]string, 0),
+		Exclude:       append([]string(nil), defaultExclude...),
+		IndexEvery:    defaultIndexEvery,
+		WalkWorkers:   defaultWalkWorkers,
+	}
+}
+
+// RootsPath is where the roots added at runtime are persisted, right next to
+// the index.
+func (c *Config) RootsPath() string {
+	return c.IndexPath + ".roots"
+}
+
+// DirTreePath is where the state of the directories under the roots is kept
+// between reindexes.
+func (c *Config) DirTreePath() string {
+	return c.IndexPath + ".dirs"
+}
+
+// MetaPath is where the metadata of the files in the index is kept.
+func (c *Config) MetaPath() string {
+	return c.IndexPath + ".meta"
+}
+
+// VisitsPath is where the visits of the files in the index are kept.
+func (c *Config) VisitsPath() string {
+	return c.IndexPath + ".visits"
+}
+
+// LoadConfig reads the config file at path on top of the defaults. A missing
+// file is not an error, the defaults are returned as is.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bs, c); err != nil {
+		return nil, err
+	}
+	if _, err := ParseSyncPolicy(c.Fsync); err != nil {
+		return nil, err
+	}
+	if c.IndexEverySeconds > 0 {
+		c.IndexEvery = time.Duration(c.IndexEverySeconds) * time.Second
+	}
+	c.IndexPath = expandHome(c.IndexPath)
+	c.StringidsPath = expandHome(c.StringidsPath)
+	for i, root := range c.Roots {
+		if c.Roots[i], err = absRoot(root); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// ParseRoots splits a comma separated list of roots as given on the command
+// line.
+func ParseRoots(s string) ([]string, error) {
+	roots := make([]string, 0)
+	for _, root := range strings.Split(s, ",") {
+		root = strings.TrimSpace(root)
+		if root == "" {
+			continue
+		}
+		abs, err := absRoot(root)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, abs)
+	}
+	return roots, nil
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", dir)
+	c, err := LoadConfig(filepath.Join(dir, "nope.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := filepath.Join(dir, "pathsearch", "index")
+	if c.IndexPath != expected {
+		t.Errorf("expected %s but got %s", expected, c.IndexPath)
+	}
+	if c.IndexEvery != defaultIndexEvery {
+		t.Errorf("expected %v but got %v", defaultIndexEvery, c.IndexEvery)
+	}
+}
+
+func TestLoadConfigOverridesDefaults(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	contents := `{"index": "/tmp/idx", "roots": ["/a/", "/b/../b"], "index_every_seconds": 30}`
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.IndexPath != "/tmp/idx" {
+		t.Errorf("expected /tmp/idx but got %s", c.IndexPath)
+	}
+	if len(c.Roots) != 2 || c.Roots[0] != "/a" || c.Roots[1] != "/b" {
+		t.Errorf("unexpected roots %v", c.Roots)
+	}
+	if c.IndexEvery != 30*time.Second {
+		t.Errorf("expected 30s but got %v", c.IndexEvery)
+	}
+}
+
+func TestParseRoots(t *testing.T) {
+	roots, err := ParseRoots(" /a, ,/b/")
+	if err != nil || len(roots) != 2 || roots[0] != "/a" || roots[1] != "/b" {
+		t.Errorf("unexpected roots %v, %v", roots, err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roots, err := ParseRoots("rel/dir"); err != nil || len(roots) != 1 || roots[0] != filepath.Join(wd, "rel", "dir") {
+		t.Errorf("expected a relative root to be made absolute but got %v, %v", roots, err)
+	}
+}
@@ -0,0 +1,467 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pankajroark/pathsearch/ds"
+)
+
+/*
+ DirTree remembers, for every directory under the roots, its mtime and its
+ entries as of the last scan. Adding, removing or renaming an entry updates
+ the mtime of the directory holding it, so a directory whose mtime did not
+ change still has the entries we recorded and does not need to be read again.
+ A scan then only has to stat directories, and reads just the ones that
+ changed, several at a time.
+
+ Changes to a directory that happen within the mtime granularity of the last
+ read could go unnoticed, so directories modified shortly before being read
+ are recorded without an mtime and read again next time.
+
+ Every file is stat'ed on every scan, whether its directory is read or not,
+ since writing to a file does not change the mtime of its directory. Their
+ metadata is kept until TakeStats hands it over.
+
+ Files added and removed by filesystem events are recorded as well, so that
+ the tree keeps listing what is in the index and the next scan does not
+ report them again. Directories the events add are recorded without an
+ mtime, the next scan reads them.
+*/
+
+const racyInterval = 2 * time.Second
+
+type dirState struct {
+	Mtime int64
+	// base names of the files and sub directories that are not ignored
+	Files []string
+	Dirs  []string
+	// patterns read from the ignore files of this directory and the newest
+	// mtime among those files, editing one does not change Mtime
+	Ignore      []string
+	IgnoreFiles []string
+	IgnoreMtime int64
+}
+
+type DirTree struct {
+	// how many directories a scan reads at once
+	Workers int
+
+	path string
+	// the global exclude list the recorded state was scanned with
+	exclude []string
+	dirs    map[string]*dirState
+	// roots scanned with ScanGit
+	git map[string]*gitState
+	// metadata of the files stat'ed since TakeStats was last called, not
+	// stored
+	stats map[string]FileMeta
+}
+
+// what is stored on disk
+type dirTreeFile struct {
+	Exclude []string
+	Dirs    map[string]*dirState
+	Git     map[string]*gitState
+}
+
+// LoadDirTree reads the tree stored at path. A missing or unreadable tree
+// is replaced by an empty one, the next scan then reads every directory. So
+// is a tree that was scanned with a different global exclude list.
+func LoadDirTree(path string, exclude []string) *DirTree {
+	t := &DirTree{Workers: defaultWalkWorkers, path: path, exclude: exclude}
+	t.Clear()
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return t
+	}
+	var f dirTreeFile
+	if err := gob.NewDecoder(bytes.NewBuffer(bs)).Decode(&f); err != nil {
+		return t
+	}
+	if strings.Join(f.Exclude, "\n") != strings.Join(exclude, "\n") || f.Dirs == nil {
+		return t
+	}
+	t.dirs = f.Dirs
+	if f.Git != nil {
+		t.git = f.Git
+	}
+	return t
+}
+
+func (t *DirTree) Store() error {
+	b := new(bytes.Buffer)
+	if err := gob.NewEncoder(b).Encode(dirTreeFile{Exclude: t.exclude, Dirs: t.dirs, Git: t.git}); err != nil {
+		return err
+	}
+	return ds.WriteFileAtomic(t.path, b.Bytes(), 0644)
+}
+
+// Clear forgets everything, the next scan reads every directory again.
+func (t *DirTree) Clear() {
+	t.dirs = make(map[string]*dirState)
+	t.git = make(map[string]*gitState)
+	t.stats = make(map[string]FileMeta)
+}
+
+// TakeStats returns the metadata of the files stat'ed by the scans since it
+// was last called, it is forgotten here.
+func (t *DirTree) TakeStats() map[string]FileMeta {
+	stats := t.stats
+	t.stats = make(map[string]FileMeta)
+	return stats
+}
+
+// RootIgnorer returns the patterns that apply to everything under root before
+// any ignore file is read.
+func (t *DirTree) RootIgnorer(root string) *Ignorer {
+	return (&Ignorer{}).With(root, t.exclude)
+}
+
+// Scan brings what is recorded about root up to date and returns the files
+// added and removed since the previous scan, sorted. known is false if
+// nothing was recorded about root yet, in which case all its files are
+// returned as added. If ctx is done before the scan completes nothing is
+// recorded and ctx's error is returned.
+func (t *DirTree) Scan(ctx context.Context, root string) (added, removed []string, known bool, err error) {
+	_, known = t.dirs[root]
+	if _, found := t.git[root]; found {
+		// what ScanGit reported is not what went into dirs
+		known = false
+	}
+	d := &treeDiff{root: root, states: make(map[string]*dirState), forgotten: make(map[string]bool), stats: make(map[string]FileMeta)}
+	fi, err := os.Stat(root)
+	if err != nil || !fi.IsDir() {
+		t.forget(root, d)
+	} else {
+		err = walkParallel(ctx, t.Workers, scanJob{dir: root, fi: fi, ig: t.RootIgnorer(root)}, func(job scanJob) []scanJob {
+			return t.scan(job, d)
+		})
+		if err != nil {
+			return nil, nil, false, err
+		}
+	}
+	delete(t.git, root)
+	for dir := range d.forgotten {
+		delete(t.dirs, dir)
+	}
+	for dir, state := range d.states {
+		t.dirs[dir] = state
+	}
+	for path, meta := range d.stats {
+		t.stats[path] = meta
+	}
+	sort.Strings(d.added)
+	sort.Strings(d.removed)
+	return d.added, d.removed, known, nil
+}
+
+// Files returns every file recorded under root.
+func (t *DirTree) Files(root string) []string {
+	files := make([]string, 0)
+	var collect func(dir string)
+	collect = func(dir string) {
+		state, found := t.dirs[dir]
+		if !found {
+			return
+		}
+		for _, name := range state.Files {
+			files = append(files, filepath.Join(dir, name))
+		}
+		for _, name := range state.Dirs {
+			collect(filepath.Join(dir, name))
+		}
+	}
+	collect(root)
+	return files
+}
+
+// AllFiles returns every file reported under root, by Scan or by ScanGit
+// whichever was used last.
+func (t *DirTree) AllFiles(root string) []string {
+	if state, found := t.git[root]; found {
+		return state.Files
+	}
+	return t.Files(root)
+}
+
+// AddFile records path, which was added other than by a scan. Nothing is
+// recorded if path is not under a directory scanned before.
+func (t *DirTree) AddFile(path string) {
+	if state := t.record(filepath.Dir(path)); state != nil {
+		state.Files = insertSorted(state.Files, filepath.Base(path))
+	}
+	for root, state := range t.git {
+		if underRoot(path, root) {
+			state.Files = insertSorted(state.Files, path)
+		}
+	}
+}
+
+// record returns the state of dir, recording dir and the directories above
+// it up to the first one scanned before. It returns nil if there is none.
+func (t *DirTree) record(dir string) *dirState {
+	if state, found := t.dirs[dir]; found {
+		return state
+	}
+	parent := filepath.Dir(dir)
+	if parent == dir {
+		return nil
+	}
+	up := t.record(parent)
+	if up == nil {
+		return nil
+	}
+	up.Dirs = insertSorted(up.Dirs, filepath.Base(dir))
+	state := &dirState{}
+	t.dirs[dir] = state
+	return state
+}
+
+// RemoveFile forgets path, which was removed other than by a scan.
+func (t *DirTree) RemoveFile(path string) {
+	if state, found := t.dirs[filepath.Dir(path)]; found {
+		state.Files = removeSorted(state.Files, filepath.Base(path))
+	}
+	for root, state := range t.git {
+		if underRoot(path, root) {
+			state.Files = removeSorted(state.Files, path)
+		}
+	}
+}
+
+// RemoveDir forgets dir and everything under it, which was removed other
+// than by a scan, and returns the files recorded under it.
+func (t *DirTree) RemoveDir(dir string) []string {
+	files := t.Files(dir)
+	var drop func(dir string)
+	drop = func(dir string) {
+		state, found := t.dirs[dir]
+		if !found {
+			return
+		}
+		delete(t.dirs, dir)
+		for _, name := range state.Dirs {
+			drop(filepath.Join(dir, name))
+		}
+	}
+	drop(dir)
+	if parent, found := t.dirs[filepath.Dir(dir)]; found {
+		parent.Dirs = removeSorted(parent.Dirs, filepath.Base(dir))
+	}
+	for root, state := range t.git {
+		if !underRoot(dir, root) || dir == root {
+			continue
+		}
+		// the files under dir sort between dir/ and dir0
+		from := sort.SearchStrings(state.Files, dir+string(filepath.Separator))
+		to := sort.SearchStrings(state.Files, dir+string(filepath.Separator+1))
+		files = append(files, state.Files[from:to]...)
+		state.Files = append(state.Files[:from:from], state.Files[to:]...)
+	}
+	sort.Strings(files)
+	return dedupSorted(files)
+}
+
+// Forget drops root and everything under it except what is under one of
+// keep.
+func (t *DirTree) Forget(root string, keep []string) {
+	for dir := range t.dirs {
+		if underRoot(dir, root) && !isUnderAny(dir, keep) {
+			delete(t.dirs, dir)
+		}
+	}
+	for dir := range t.git {
+		if underRoot(dir, root) && !isUnderAny(dir, keep) {
+			delete(t.git, dir)
+		}
+	}
+}
+
+// treeDiff collects what a scan found, it is only applied to the tree once
+// the scan is complete. t.dirs is not written during a scan so visits can
+// read it without locking.
+type treeDiff struct {
+	root string
+
+	mu        sync.Mutex
+	added     []string
+	removed   []string
+	states    map[string]*dirState
+	forgotten map[string]bool
+	stats     map[string]FileMeta
+}
+
+// scanJob is a directory to scan, ig holds the patterns of the directories
+// above it and force makes it read dir even if its mtime did not change,
+// which is needed when the patterns of a parent changed.
+type scanJob struct {
+	dir   string
+	fi    os.FileInfo
+	ig    *Ignorer
+	force bool
+}
+
+// scan updates job.dir and returns its sub directories.
+func (t *DirTree) scan(job scanJob, d *treeDiff) []scanJob {
+	dir := job.dir
+	old := t.dirs[dir]
+	mtime := job.fi.ModTime().UnixNano()
+	if !job.force && old != nil && old.Mtime != 0 && old.Mtime == mtime &&
+		ignoreMtime(dir, old.IgnoreFiles) == old.IgnoreMtime {
+		stats := make(map[string]FileMeta, len(old.Files))
+		for _, name := range old.Files {
+			path := filepath.Join(dir, name)
+			if fi, err := os.Lstat(path); err == nil {
+				stats[path] = fileMetaOf(fi)
+			}
+		}
+		d.mu.Lock()
+		for path, meta := range stats {
+			d.stats[path] = meta
+		}
+		d.mu.Unlock()
+		return t.subdirs(dir, old.Dirs, job.ig.With(dir, old.Ignore), false, d)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.forget(dir, d)
+		return nil
+	}
+	state := &dirState{Mtime: mtime}
+	if time.Since(job.fi.ModTime()) < racyInterval {
+		state.Mtime = 0
+	}
+	for _, entry := range entries {
+		if isIgnoreFile(entry.Name(), dir == d.root) {
+			state.IgnoreFiles = append(state.IgnoreFiles, entry.Name())
+		}
+	}
+	state.Ignore = readIgnoreFiles(dir, state.IgnoreFiles, dir == d.root)
+	state.IgnoreMtime = ignoreMtime(dir, state.IgnoreFiles)
+	ig := job.ig.With(dir, state.Ignore)
+	stats := make(map[string]FileMeta)
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if ig.Ignored(path, entry.IsDir()) {
+			continue
+		}
+		if entry.IsDir() {
+			state.Dirs = append(state.Dirs, entry.Name())
+		} else {
+			state.Files = append(state.Files, entry.Name())
+			if fi, err := entry.Info(); err == nil {
+				stats[path] = fileMetaOf(fi)
+			}
+		}
+	}
+	if old == nil {
+		old = &dirState{}
+	}
+	d.mu.Lock()
+	for _, name := range missing(state.Files, old.Files) {
+		d.added = append(d.added, filepath.Join(dir, name))
+	}
+	for _, name := range missing(old.Files, state.Files) {
+		d.removed = append(d.removed, filepath.Join(dir, name))
+	}
+	d.states[dir] = state
+	for path, meta := range stats {
+		d.stats[path] = meta
+	}
+	d.mu.Unlock()
+	for _, name := range missing(old.Dirs, state.Dirs) {
+		t.forget(filepath.Join(dir, name), d)
+	}
+	// what is below has to be filtered again if the patterns changed
+	force := job.force || strings.Join(state.Ignore, "\n") != strings.Join(old.Ignore, "\n")
+	return t.subdirs(dir, state.Dirs, ig, force, d)
+}
+
+// subdirs stats the sub directories of dir, names, and returns the ones that
+// are still directories to be scanned.
+func (t *DirTree) subdirs(dir string, names []string, ig *Ignorer, force bool, d *treeDiff) []scanJob {
+	jobs := make([]scanJob, 0, len(names))
+	for _, name := range names {
+		sub := filepath.Join(dir, name)
+		fi, err := os.Lstat(sub)
+		if err != nil || !fi.IsDir() {
+			t.forget(sub, d)
+			continue
+		}
+		jobs = append(jobs, scanJob{dir: sub, fi: fi, ig: ig, force: force})
+	}
+	return jobs
+}
+
+// ignoreMtime returns the newest mtime among the ignore files of dir.
+func ignoreMtime(dir string, names []string) int64 {
+	var newest int64
+	for _, name := range names {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		if mtime := fi.ModTime().UnixNano(); mtime > newest {
+			newest = mtime
+		}
+	}
+	return newest
+}
+
+// forget drops dir and everything under it, reporting its files as removed.
+func (t *DirTree) forget(dir string, d *treeDiff) {
+	state, found := t.dirs[dir]
+	if !found {
+		return
+	}
+	d.mu.Lock()
+	for _, name := range state.Files {
+		d.removed = append(d.removed, filepath.Join(dir, name))
+	}
+	d.forgotten[dir] = true
+	d.mu.Unlock()
+	for _, name := range state.Dirs {
+		t.forget(filepath.Join(dir, name), d)
+	}
+}
+
+// insertSorted adds s to the sorted ss unless it is there already.
+func insertSorted(ss []string, s string) []string {
+	i := sort.SearchStrings(ss, s)
+	if i < len(ss) && ss[i] == s {
+		return ss
+	}
+	return append(ss[:i:i], append([]string{s}, ss[i:]...)...)
+}
+
+// removeSorted drops s from the sorted ss.
+func removeSorted(ss []string, s string) []string {
+	i := sort.SearchStrings(ss, s)
+	if i == len(ss) || ss[i] != s {
+		return ss
+	}
+	return append(ss[:i:i], ss[i+1:]...)
+}
+
+// missing returns the names in xs that are not in ys, both are sorted as
+// returned by ReadDir.
+func missing(xs, ys []string) []string {
+	ret := make([]string, 0)
+	for _, x := range xs {
+		i := sort.SearchStrings(ys, x)
+		if i == len(ys) || ys[i] != x {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func sameStrings(xs, ys []string) bool {
+	xs = append([]string(nil), xs...)
+	ys = append([]string(nil), ys...)
+	sort.Strings(xs)
+	sort.Strings(ys)
+	if len(xs) != len(ys) {
+		return false
+	}
+	for i := range xs {
+		if xs[i] != ys[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func scanTree(t *testing.T, tree *DirTree, root string) ([]string, []string, bool) {
+	added, removed, known, err := tree.Scan(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return added, removed, known
+}
+
+func TestDirTreeScan(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	a := filepath.Join(root, "a.go")
+	b := filepath.Join(root, "sub", "b.go")
+	touch(t, a)
+	touch(t, b)
+	touch(t, filepath.Join(root, "Skipped.class"))
+
+	tree := LoadDirTree(filepath.Join(dir, "tree"), defaultExclude)
+	added, removed, known := scanTree(t, tree, root)
+	if known {
+		t.Error("root known before the first scan")
+	}
+	if !sameStrings(added, []string{a, b}) || len(removed) != 0 {
+		t.Errorf("unexpected first scan %v %v", added, removed)
+	}
+
+	added, removed, known = scanTree(t, tree, root)
+	if !known || len(added) != 0 || len(removed) != 0 {
+		t.Errorf("unexpected rescan %v %v %v", added, removed, known)
+	}
+
+	c := filepath.Join(root, "sub", "deeper", "c.go")
+	touch(t, c)
+	if err := os.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Store(); err != nil {
+		t.Fatal(err)
+	}
+	tree = LoadDirTree(filepath.Join(dir, "tree"), defaultExclude)
+	added, removed, _ = scanTree(t, tree, root)
+	if !sameStrings(added, []string{c}) || !sameStrings(removed, []string{a}) {
+		t.Errorf("unexpected scan after changes %v %v", added, removed)
+	}
+
+	if err := os.RemoveAll(filepath.Join(root, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	added, removed, _ = scanTree(t, tree, root)
+	if len(added) != 0 || !sameStrings(removed, []string{b, c}) {
+		t.Errorf("unexpected scan after removing a dir %v %v", added, removed)
+	}
+	if files := tree.Files(root); len(files) != 0 {
+		t.Errorf("unexpected files left %v", files)
+	}
+}
+
+func TestDirTreeFromEvents(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	a := filepath.Join(root, "a.go")
+	b := filepath.Join(root, "sub", "b.go")
+	touch(t, a)
+	touch(t, b)
+	tree := LoadDirTree(filepath.Join(dir, "tree"), defaultExclude)
+	scanTree(t, tree, root)
+
+	c := filepath.Join(root, "sub", "deeper", "c.go")
+	touch(t, c)
+	tree.AddFile(c)
+	if err := os.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	tree.RemoveFile(a)
+	if files := tree.Files(root); !sameStrings(files, []string{b, c}) {
+		t.Errorf("unexpected files after events %v", files)
+	}
+	added, removed, _ := scanTree(t, tree, root)
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("expected the scan to agree with the events but got %v %v", added, removed)
+	}
+
+	if err := os.Rename(filepath.Join(root, "sub"), filepath.Join(dir, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	if files := tree.RemoveDir(filepath.Join(root, "sub")); !sameStrings(files, []string{b, c}) {
+		t.Errorf("expected the files of the removed dir but got %v", files)
+	}
+	added, removed, _ = scanTree(t, tree, root)
+	if len(added) != 0 || len(removed) != 0 || len(tree.Files(root)) != 0 {
+		t.Errorf("expected nothing left to scan but got %v %v", added, removed)
+	}
+
+	// nothing is recorded outside of the scanned roots
+	tree.AddFile(filepath.Join(dir, "elsewhere", "d.go"))
+	if files := tree.Files(filepath.Join(dir, "elsewhere")); len(files) != 0 {
+		t.Errorf("unexpected files outside the roots %v", files)
+	}
+}
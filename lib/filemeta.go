@@ -0,0 +1,210 @@
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pankajroark/pathsearch/ds"
+)
+
+/*
+ Besides its path we keep, for every file in the index, its size, mtime and
+ mode as of the last walk, the root it was found under and the generation of
+ that walk. Walks count generations up and stat every file, files that
+ changed in between are stat'ed again from filesystem events where those are
+ watched. A file added by an event gets the generation of the latest walk.
+
+ The metadata is an idTable, its header holds the walk generation.
+*/
+
+const metaMagic = "PSMD"
+
+type FileMode uint8
+
+const (
+	ModeFile FileMode = 1 << iota
+	ModeDir
+	ModeSymlink
+	// regular files with an executable bit, they are ModeFile as well
+	ModeExec
+)
+
+type FileMeta struct {
+	Size int64
+	// unix nanoseconds
+	Mtime int64
+	Mode  FileMode
+	// RootId of the root the file was found under
+	Root uint32
+	// walk that last looked at the file
+	Generation uint32
+}
+
+// size, mtime, mode, root, generation
+var fileMetaCodec = ds.FixedCodec[FileMeta]{
+	Width: 25,
+	Put: func(b []byte, m FileMeta) {
+		binary.LittleEndian.PutUint64(b, uint64(m.Size))
+		binary.LittleEndian.PutUint64(b[8:], uint64(m.Mtime))
+		b[16] = byte(m.Mode)
+		binary.LittleEndian.PutUint32(b[17:], m.Root)
+		binary.LittleEndian.PutUint32(b[21:], m.Generation)
+	},
+	Read: func(b []byte) FileMeta {
+		return FileMeta{
+			Size:       int64(binary.LittleEndian.Uint64(b)),
+			Mtime:      int64(binary.LittleEndian.Uint64(b[8:])),
+			Mode:       FileMode(b[16]),
+			Root:       binary.LittleEndian.Uint32(b[17:]),
+			Generation: binary.LittleEndian.Uint32(b[21:]),
+		}
+	},
+}
+
+// fileMetaOf returns the size, mtime and mode of fi, as returned by Lstat.
+func fileMetaOf(fi os.FileInfo) FileMeta {
+	m := FileMeta{Size: fi.Size(), Mtime: fi.ModTime().UnixNano()}
+	switch mode := fi.Mode(); {
+	case mode&os.ModeSymlink != 0:
+		m.Mode = ModeSymlink
+	case mode.IsDir():
+		m.Mode = ModeDir
+	case mode.IsRegular():
+		m.Mode = ModeFile
+		if mode.Perm()&0111 != 0 {
+			m.Mode |= ModeExec
+		}
+	}
+	return m
+}
+
+// RootId identifies root in FileMeta.
+func RootId(root string) uint32 {
+	return crc32.Checksum([]byte(filepath.Clean(root)), castagnoli)
+}
+
+// MetaStore is the metadata of the files of one stringids, the generation
+// of the latest walk is kept in the header.
+type MetaStore struct {
+	*idTable[FileMeta]
+}
+
+// OpenMetaStore reads the metadata stored at path, see openIdTable.
+func OpenMetaStore(path string, stringidsGeneration uint64) (*MetaStore, bool) {
+	t, loaded := openIdTable[FileMeta](path, metaMagic, "file metadata", fileMetaCodec, stringidsGeneration)
+	return &MetaStore{t}, loaded
+}
+
+// Put sets the metadata of id and reports whether its size or mtime changed
+// since the last Put.
+func (m *MetaStore) Put(id uint32, meta FileMeta) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, found, _ := m.table.Get(id)
+	m.table.Put(id, meta)
+	m.dirty = true
+	return found && (old.Size != meta.Size || old.Mtime != meta.Mtime)
+}
+
+// Generation returns the generation of the latest walk.
+func (m *MetaStore) Generation() uint32 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.extra
+}
+
+// NextGeneration starts a walk and returns its generation.
+func (m *MetaStore) NextGeneration() uint32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.extra++
+	m.dirty = true
+	return m.extra
+}
+
+// Remapped returns the metadata for the stringids of generation, whose ids are
+// the ones in remap. Ids remap does not have are dropped.
+func (m *MetaStore) Remapped(remap map[uint32]uint32, stringidsGeneration uint64) *MetaStore {
+	return &MetaStore{m.remapped(remap, stringidsGeneration)}
+}
+
+// Filter narrows matches down by the metadata of the files, files without
+// metadata never pass. Zero fields match anything.
+type Filter struct {
+	// any of
+	Modes FileMode
+	// RootId of the root
+	Root    uint32
+	MinSize int64
+	MaxSize int64
+	// unix nanoseconds
+	ModifiedAfter int64
+}
+
+// ParseFilter reads a filter from the parameters of a query:
+//
+//	type     comma separated file, dir, symlink or exec
+//	root     one of the roots
+//	minsize  in bytes
+//	maxsize  in bytes
+//	newer    a duration, e.g. 24h, files modified within it
+//
+// It returns nil if there is nothing to filter by.
+func ParseFilter(params url.Values, now time.Time) (*Filter, error) {
+	f := &Filter{}
+	for _, t := range strings.Split(params.Get("type"), ",") {
+		switch strings.TrimSpace(t) {
+		case "":
+		case "file":
+			f.Modes |= ModeFile
+		case "dir":
+			f.Modes |= ModeDir
+		case "symlink":
+			f.Modes |= ModeSymlink
+		case "exec":
+			f.Modes |= ModeExec
+		default:
+			return nil, fmt.Errorf("unknown file type %q", t)
+		}
+	}
+	var err error
+	if root := params.Get("root"); root != "" {
+		if root, err = absRoot(root); err != nil {
+			return nil, err
+		}
+		f.Root = RootId(root)
+	}
+	for name, size := range map[string]*int64{"minsize": &f.MinSize, "maxsize": &f.MaxSize} {
+		if v := params.Get(name); v != "" {
+			if *size, err = strconv.ParseInt(v, 10, 64); err != nil || *size < 0 {
+				return nil, fmt.Errorf("bad %s %q", name, v)
+			}
+		}
+	}
+	if v := params.Get("newer"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad newer %q", v)
+		}
+		f.ModifiedAfter = now.Add(-d).UnixNano()
+	}
+	if *f == (Filter{}) {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func (f *Filter) Match(meta FileMeta) bool {
+	return (f.Modes == 0 || meta.Mode&f.Modes != 0) &&
+		(f.Root == 0 || meta.Root == f.Root) &&
+		meta.Size >= f.MinSize &&
+		(f.MaxSize == 0 || meta.Size <= f.MaxSize) &&
+		meta.Mtime >= f.ModifiedAfter
+}
@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetaStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meta")
+	m, loaded := OpenMetaStore(path, 7)
+	if loaded {
+		t.Error("loaded metadata that does not exist")
+	}
+	generation := m.NextGeneration()
+	meta := FileMeta{Size: 10, Mtime: 20, Mode: ModeFile | ModeExec, Root: RootId("/root"), Generation: generation}
+	if m.Put(1, meta) {
+		t.Error("a new file reported as changed")
+	}
+	m.Put(2, FileMeta{Size: 1})
+	m.Delete(2)
+	if err := m.Store(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, loaded := OpenMetaStore(path, 7)
+	if got, found := reopened.Get(1); !loaded || !found || got != meta {
+		t.Errorf("expected %v but got %v, %v", meta, got, found)
+	}
+	if _, found := reopened.Get(2); found {
+		t.Error("found deleted metadata")
+	}
+	if reopened.Generation() != generation {
+		t.Errorf("expected generation %d but got %d", generation, reopened.Generation())
+	}
+	if !reopened.Put(1, FileMeta{Size: 11, Mtime: 20}) {
+		t.Error("a resized file not reported as changed")
+	}
+	if _, loaded := OpenMetaStore(path, 8); loaded {
+		t.Error("loaded metadata of other stringids")
+	}
+
+	remapped := reopened.Remapped(map[uint32]uint32{1: 5}, 8)
+	if got, found := remapped.Get(5); !found || got.Size != 11 {
+		t.Errorf("expected remapped metadata but got %v, %v", got, found)
+	}
+	if _, found := remapped.Get(1); found {
+		t.Error("found metadata under the old id")
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	f, err := ParseFilter(url.Values{"type": {"exec,symlink"}, "minsize": {"5"}, "newer": {"10s"}, "root": {"/r/"}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passing := FileMeta{Size: 5, Mtime: time.Unix(995, 0).UnixNano(), Mode: ModeFile | ModeExec, Root: RootId("/r")}
+	if !f.Match(passing) {
+		t.Errorf("%v does not pass %v", passing, f)
+	}
+	for _, failing := range []FileMeta{
+		{Size: 5, Mtime: passing.Mtime, Mode: ModeFile, Root: passing.Root},
+		{Size: 4, Mtime: passing.Mtime, Mode: ModeSymlink, Root: passing.Root},
+		{Size: 5, Mtime: time.Unix(980, 0).UnixNano(), Mode: ModeSymlink, Root: passing.Root},
+		{Size: 5, Mtime: passing.Mtime, Mode: ModeSymlink, Root: RootId("/other")},
+	} {
+		if f.Match(failing) {
+			t.Errorf("%v passes %v", failing, f)
+		}
+	}
+	if f, err := ParseFilter(url.Values{"word": {"abc"}}, now); f != nil || err != nil {
+		t.Errorf("expected no filter but got %v, %v", f, err)
+	}
+	for _, bad := range []url.Values{{"type": {"pipe"}}, {"maxsize": {"-1"}}, {"newer": {"yesterday"}}} {
+		if _, err := ParseFilter(bad, now); err == nil {
+			t.Errorf("expected %v to be an error", bad)
+		}
+	}
+}
+
+func TestFileMetaFromWalk(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	small := filepath.Join(root, "tinyfile.go")
+	large := filepath.Join(root, "sub", "hugefile.go")
+	script := filepath.Join(root, "runscript.sh")
+	writeFile(t, small, "x")
+	writeFile(t, large, "0123456789")
+	writeFile(t, script, "#!/bin/sh")
+	if err := os.Chmod(script, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s := testServer(t, root)
+	id, err := s.stringids.GetId(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, found := s.meta.Get(id)
+	if !found || meta.Size != 10 || meta.Mode != ModeFile || meta.Root != RootId(root) || meta.Generation != s.meta.Generation() {
+		t.Errorf("unexpected metadata %v, %v", meta, found)
+	}
+	if matches := s.FindMatchesWith("hugefile", &Filter{MinSize: 5}); !contains(matches, large) {
+		t.Errorf("expected %s to be at least 5 bytes but got %v", large, matches)
+	}
+	if matches := s.FindMatchesWith("tinyfile", &Filter{MinSize: 5}); len(matches) != 0 {
+		t.Errorf("expected nothing of at least 5 bytes but got %v", matches)
+	}
+	if matches := s.FindMatchesWith("runscript", &Filter{Modes: ModeExec}); !contains(matches, script) {
+		t.Errorf("expected %s to be executable but got %v", script, matches)
+	}
+
+	writeFile(t, large, "01234567890123456789")
+	s.Index()
+	if meta, _ := s.meta.Get(id); meta.Size != 20 {
+		t.Errorf("expected the new size to be recorded but got %v", meta)
+	}
+	s.Close()
+
+	restarted := &Server{}
+	restarted.Init(s.config)
+	defer restarted.Close()
+	if meta, found := restarted.meta.Get(id); !found || meta.Size != 20 {
+		t.Errorf("expected stored metadata but got %v, %v", meta, found)
+	}
+}
+
+func TestFileMetaOfEditedFile(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	file := filepath.Join(root, "sub", "editedfile.go")
+	writeFile(t, file, "0123456789")
+	// old enough for the directories not to be read again
+	hourAgo := time.Now().Add(-time.Hour)
+	for _, path := range []string{file, filepath.Dir(file), root} {
+		if err := os.Chtimes(path, hourAgo, hourAgo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := testServer(t, root)
+	filter := &Filter{MinSize: 15, ModifiedAfter: time.Now().Add(-time.Minute).UnixNano()}
+	if matches := s.FindMatchesWith("editedfile", filter); len(matches) != 0 {
+		t.Errorf("expected nothing large and new but got %v", matches)
+	}
+	// writing to a file leaves the mtime of its directory alone
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("0123456789"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if fi, err := os.Stat(filepath.Dir(file)); err != nil || !fi.ModTime().Equal(hourAgo) {
+		t.Fatalf("expected the directory to keep its mtime but got %v, %v", fi, err)
+	}
+
+	s.Index()
+	if matches := s.FindMatchesWith("editedfile", filter); !contains(matches, file) {
+		t.Errorf("expected %s to be large and new but got %v", file, matches)
+	}
+	id, err := s.stringids.GetId(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ := s.meta.Get(id); meta.Generation != s.meta.Generation() {
+		t.Errorf("expected generation %d but got %v", s.meta.Generation(), meta)
+	}
+}
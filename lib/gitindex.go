@@ -0,0 +1,312 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ For roots that are git repositories the list of files can be taken from the
+ git index instead of the file system. It holds every tracked path, sorted
+ and already filtered by the repository's ignore rules, so reading it is a
+ single sequential read however large the tree is.
+
+ The index is a "DIRC" header followed by one entry per path and stage and by
+ extensions we do not need, see git's Documentation/gitformat-index.txt.
+ Versions 2, 3 and 4 are understood, version 4 prefix compresses the paths.
+*/
+
+var errNotGitRepo = errors.New("not a git repository")
+
+// gitlinks, i.e. submodules, have this mode and are directories on disk
+const gitlinkMode = 0160000
+
+// gitDir returns the git directory of the repository whose top level is root.
+func gitDir(root string) (string, error) {
+	dotgit := filepath.Join(root, ".git")
+	fi, err := os.Stat(dotgit)
+	if err != nil {
+		return "", errNotGitRepo
+	}
+	if fi.IsDir() {
+		return dotgit, nil
+	}
+	// worktrees and submodules have a file pointing at the git directory
+	bs, err := ioutil.ReadFile(dotgit)
+	if err != nil {
+		return "", err
+	}
+	line := strings.TrimSpace(string(bs))
+	if !strings.HasPrefix(line, "gitdir: ") {
+		return "", errNotGitRepo
+	}
+	dir := strings.TrimPrefix(line, "gitdir: ")
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+	return dir, nil
+}
+
+// gitHashSize returns the size of object names in the repository, sha1 unless
+// its config says otherwise.
+func gitHashSize(dir string) int {
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "config"))
+	if err == nil {
+		for _, line := range strings.Split(string(bs), "\n") {
+			line = strings.ToLower(strings.Join(strings.Fields(line), ""))
+			if line == "objectformat=sha256" {
+				return 32
+			}
+		}
+	}
+	return 20
+}
+
+// readGitIndex returns the paths in a git index, relative to the top level of
+// the repository, sorted and without duplicates. Submodules are left out.
+func readGitIndex(bs []byte, hashSize int) ([]string, error) {
+	if len(bs) < 12+hashSize || string(bs[:4]) != "DIRC" {
+		return nil, errors.New("not a git index")
+	}
+	version := binary.BigEndian.Uint32(bs[4:8])
+	if version < 2 || version > 4 {
+		return nil, fmt.Errorf("unsupported git index version %d", version)
+	}
+	count := binary.BigEndian.Uint32(bs[8:12])
+	// the trailing checksum is not verified, git does that when writing
+	end := len(bs) - hashSize
+	paths := make([]string, 0, count)
+	pos := 12
+	prev := ""
+	// ctime, mtime, dev, ino, mode, uid, gid, size, object name and flags
+	fixed := 40 + hashSize + 2
+	for i := uint32(0); i < count; i++ {
+		if pos+fixed > end {
+			return nil, errors.New("truncated git index")
+		}
+		mode := binary.BigEndian.Uint32(bs[pos+24 : pos+28])
+		flags := binary.BigEndian.Uint16(bs[pos+fixed-2 : pos+fixed])
+		entryStart := pos
+		pos += fixed
+		if version >= 3 && flags&0x4000 != 0 {
+			// extended flags
+			pos += 2
+		}
+		var path string
+		if version == 4 {
+			strip, n := gitVarint(bs[pos:end])
+			if n == 0 || int(strip) > len(prev) {
+				return nil, errors.New("corrupt git index path")
+			}
+			pos += n
+			nul := bytes.IndexByte(bs[pos:end], 0)
+			if nul < 0 {
+				return nil, errors.New("truncated git index")
+			}
+			path = prev[:len(prev)-int(strip)] + string(bs[pos:pos+nul])
+			pos += nul + 1
+		} else {
+			nul := bytes.IndexByte(bs[pos:end], 0)
+			if nul < 0 {
+				return nil, errors.New("truncated git index")
+			}
+			path = string(bs[pos : pos+nul])
+			// entries are padded with 1 to 8 nuls to a multiple of 8
+			pos = entryStart + (pos+nul-entryStart+8)&^7
+		}
+		prev = path
+		if mode == gitlinkMode {
+			continue
+		}
+		// unmerged paths have an entry per stage, they are adjacent
+		if len(paths) == 0 || paths[len(paths)-1] != path {
+			paths = append(paths, path)
+		}
+	}
+	if !sort.StringsAreSorted(paths) {
+		sort.Strings(paths)
+	}
+	return paths, nil
+}
+
+// gitVarint decodes the offset encoding git uses in version 4 indexes. It
+// returns the value and the number of bytes read, 0 if bs is too short.
+func gitVarint(bs []byte) (uint64, int) {
+	if len(bs) == 0 {
+		return 0, 0
+	}
+	c := bs[0]
+	val := uint64(c & 127)
+	n := 1
+	for c&128 != 0 {
+		if n == len(bs) {
+			return 0, 0
+		}
+		c = bs[n]
+		n++
+		val = ((val + 1) << 7) | uint64(c&127)
+	}
+	return val, n
+}
+
+type gitState struct {
+	IndexMtime int64
+	Checksum   []byte
+	// tracked paths relative to the root as of Checksum
+	Tracked []string
+	// sorted files reported by the previous scan
+	Files []string
+}
+
+// ScanGit is Scan for a root that is the top level of a git repository, the
+// tracked files come from the git index. It is only read again when its mtime
+// changed and its checksum with it. With untracked, files that are neither
+// tracked nor ignored are found by scanning the directories as well. Every
+// file is stat'ed, several at a time. It fails with errNotGitRepo if root is
+// not a repository.
+func (t *DirTree) ScanGit(ctx context.Context, root string, untracked bool) (added, removed []string, known bool, err error) {
+	dir, err := gitDir(root)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	old, known := t.git[root]
+	if !known {
+		old = &gitState{}
+	}
+	state := &gitState{Tracked: old.Tracked}
+
+	indexPath := filepath.Join(dir, "index")
+	hashSize := gitHashSize(dir)
+	fi, err := os.Stat(indexPath)
+	if err == nil {
+		state.IndexMtime = fi.ModTime().UnixNano()
+		state.Checksum = old.Checksum
+	}
+	if err == nil && (state.IndexMtime != old.IndexMtime || old.IndexMtime == 0) {
+		bs, err := ioutil.ReadFile(indexPath)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if len(bs) < hashSize {
+			return nil, nil, false, errors.New("truncated git index")
+		}
+		state.Checksum = append([]byte(nil), bs[len(bs)-hashSize:]...)
+		if !bytes.Equal(state.Checksum, old.Checksum) {
+			if state.Tracked, err = readGitIndex(bs, hashSize); err != nil {
+				return nil, nil, false, err
+			}
+		}
+		if time.Since(fi.ModTime()) < racyInterval {
+			state.IndexMtime = 0
+		}
+	} else if err != nil {
+		// a fresh repository has no index until something is added
+		state.Tracked = nil
+	}
+
+	ig := t.RootIgnorer(root).With(root, readIgnoreFiles(root, []string{rootIgnoreFile}, true))
+	files := make([]string, 0, len(state.Tracked))
+	for _, rel := range state.Tracked {
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if !ignoredPath(ig, root, path) {
+			files = append(files, path)
+		}
+	}
+	if untracked {
+		if _, _, _, err := t.Scan(ctx, root); err != nil {
+			return nil, nil, false, err
+		}
+		files = append(files, t.Files(root)...)
+	} else {
+		// whatever Scan recorded is stale from here on
+		for dir := range t.dirs {
+			if underRoot(dir, root) {
+				delete(t.dirs, dir)
+			}
+		}
+	}
+	sort.Strings(files)
+	state.Files = dedupSorted(files)
+
+	added = missing(state.Files, old.Files)
+	removed = missing(old.Files, state.Files)
+	unstated := make([]string, 0, len(state.Files))
+	for _, path := range state.Files {
+		// the scan for untracked files stat'ed what it found
+		if _, found := t.stats[path]; !found {
+			unstated = append(unstated, path)
+		}
+	}
+	if err := t.stat(ctx, unstated); err != nil {
+		return nil, nil, false, err
+	}
+	t.git[root] = state
+	return added, removed, known, nil
+}
+
+// stat records the metadata of paths in stats, Workers at a time.
+func (t *DirTree) stat(ctx context.Context, paths []string) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	workers := t.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	chunk := (len(paths) + workers - 1) / workers
+	for start := 0; start < len(paths); start += chunk {
+		end := start + chunk
+		if end > len(paths) {
+			end = len(paths)
+		}
+		wg.Add(1)
+		go func(paths []string) {
+			defer wg.Done()
+			stats := make(map[string]FileMeta, len(paths))
+			for _, path := range paths {
+				if ctx.Err() != nil {
+					return
+				}
+				if fi, err := os.Lstat(path); err == nil {
+					stats[path] = fileMetaOf(fi)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for path, meta := range stats {
+				t.stats[path] = meta
+			}
+		}(paths[start:end])
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// ignoredPath checks path and the directories above it up to root against ig.
+func ignoredPath(ig *Ignorer, root, path string) bool {
+	for dir := filepath.Dir(path); dir != root && underRoot(dir, root); dir = filepath.Dir(dir) {
+		if ig.Ignored(dir, true) {
+			return true
+		}
+	}
+	return ig.Ignored(path, false)
+}
+
+func dedupSorted(ss []string) []string {
+	ret := ss[:0]
+	for i, s := range ss {
+		if i == 0 || s != ss[i-1] {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
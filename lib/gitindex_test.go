@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func gitCmd(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+	return string(out)
+}
+
+func testRepo(t *testing.T) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	root := filepath.Join(t.TempDir(), "repo")
+	touch(t, filepath.Join(root, "README"))
+	touch(t, filepath.Join(root, "lib", "server.go"))
+	touch(t, filepath.Join(root, "lib", "deep", "nested", "a_rather_long_file_name_to_pad.go"))
+	touch(t, filepath.Join(root, "untracked.go"))
+	touch(t, filepath.Join(root, "build", "out.bin"))
+	writeFile(t, filepath.Join(root, ".gitignore"), "build/\n")
+	gitCmd(t, root, "init", "-q")
+	gitCmd(t, root, "add", "README", "lib", ".gitignore")
+	return root
+}
+
+func TestReadGitIndexVersions(t *testing.T) {
+	root := testRepo(t)
+	expected := strings.Fields(gitCmd(t, root, "ls-files"))
+	for _, version := range []string{"2", "3", "4"} {
+		gitCmd(t, root, "update-index", "--index-version", version)
+		bs, err := ioutil.ReadFile(filepath.Join(root, ".git", "index"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths, err := readGitIndex(bs, 20)
+		if err != nil {
+			t.Fatalf("version %s: %v", version, err)
+		}
+		if !sameStrings(paths, expected) {
+			t.Errorf("version %s: expected %v but got %v", version, expected, paths)
+		}
+	}
+}
+
+func TestScanGit(t *testing.T) {
+	root := testRepo(t)
+	tree := LoadDirTree(filepath.Join(t.TempDir(), "tree"), defaultExclude)
+	added, _, known, err := tree.ScanGit(context.Background(), root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := filepath.Join(root, "lib", "server.go")
+	if known || !contains(added, server) || contains(added, filepath.Join(root, "untracked.go")) {
+		t.Errorf("unexpected first scan %v %v", added, known)
+	}
+
+	gitCmd(t, root, "rm", "-q", "--cached", "lib/server.go")
+	added, removed, known, err := tree.ScanGit(context.Background(), root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// still there as an untracked file
+	if !known || contains(removed, server) {
+		t.Errorf("unexpected removed %v", removed)
+	}
+	if !sameStrings(added, []string{filepath.Join(root, "untracked.go")}) {
+		t.Errorf("unexpected added %v", added)
+	}
+
+	if _, _, _, err := tree.ScanGit(context.Background(), filepath.Join(root, "lib"), false); err != errNotGitRepo {
+		t.Errorf("expected errNotGitRepo but got %v", err)
+	}
+}
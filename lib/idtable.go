@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/pankajroark/pathsearch/ds"
+)
+
+/*
+ What we keep about files by their path id, their metadata and their
+ visits, is an idTable: a ds.HashTable from ids to fixed size values, stored
+ next to the index in a file with this header:
+	magic, 4 bytes
+	version uint32
+	generation uint64, of the stringids the ids are from
+	extra uint32, for the user of the table
+	unused uint32
+ followed by the table as ds.HashTable.AppendBytes writes it. Ids mean
+ nothing with other stringids, compacting stringids remaps the tables and a
+ table of other stringids is dropped when read.
+
+ Reads may happen while the table is written to.
+*/
+
+const idTableVersion = 1
+const idTableHeaderSize = 24
+
+type idTable[V any] struct {
+	mu     sync.RWMutex
+	path   string
+	magic  string
+	values ds.Codec[V]
+	table  *ds.HashTable[uint32, V]
+	// of the stringids
+	stringidsGeneration uint64
+	extra               uint32
+	dirty               bool
+}
+
+// openIdTable reads the table stored at path. It is empty if there is none,
+// it can't be read or it is of other stringids than the ones of generation,
+// loaded tells whether it was read.
+func openIdTable[V any](path, magic, name string, values ds.Codec[V], stringidsGeneration uint64) (t *idTable[V], loaded bool) {
+	t = &idTable[V]{path: path, magic: magic, values: values, stringidsGeneration: stringidsGeneration}
+	t.Clear()
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return t, false
+	}
+	if err := t.decode(bs); err != nil {
+		fmt.Printf("Stored %s are unusable, starting over: %v\n", name, err)
+		t.Clear()
+		return t, false
+	}
+	return t, true
+}
+
+func (t *idTable[V]) decode(bs []byte) error {
+	if len(bs) < idTableHeaderSize || string(bs[:4]) != t.magic {
+		return fmt.Errorf("not a %s file", t.magic)
+	}
+	if version := binary.LittleEndian.Uint32(bs[4:8]); version != idTableVersion {
+		return fmt.Errorf("unknown version %d", version)
+	}
+	if binary.LittleEndian.Uint64(bs[8:16]) != t.stringidsGeneration {
+		return errors.New("ids of other stringids")
+	}
+	table, err := ds.HashTableFromBytes[uint32, V](ds.Uint32Codec{}, t.values, bs[idTableHeaderSize:])
+	if err != nil {
+		return err
+	}
+	t.table = table
+	t.extra = binary.LittleEndian.Uint32(bs[16:20])
+	return nil
+}
+
+// Store writes the table out if it changed since it was last stored.
+func (t *idTable[V]) Store() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.dirty {
+		return nil
+	}
+	bs := make([]byte, idTableHeaderSize)
+	copy(bs, t.magic)
+	binary.LittleEndian.PutUint32(bs[4:8], idTableVersion)
+	binary.LittleEndian.PutUint64(bs[8:16], t.stringidsGeneration)
+	binary.LittleEndian.PutUint32(bs[16:20], t.extra)
+	if err := ds.WriteFileAtomic(t.path, t.table.AppendBytes(bs), 0644); err != nil {
+		return err
+	}
+	t.dirty = false
+	return nil
+}
+
+// Clear forgets every id.
+func (t *idTable[V]) Clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.table = ds.CreateHashTable[uint32, V](ds.Uint32Codec{}, t.values, 1024, ds.DefaultSeed)
+	t.dirty = true
+}
+
+func (t *idTable[V]) Get(id uint32) (V, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	v, found, err := t.table.Get(id)
+	return v, found && err == nil
+}
+
+func (t *idTable[V]) Delete(id uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if deleted, _ := t.table.Delete(id); deleted {
+		t.dirty = true
+	}
+}
+
+// Retain drops every id keep rejects.
+func (t *idTable[V]) Retain(keep func(id uint32) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	drop := make([]uint32, 0)
+	t.table.ForAll(func(id uint32, v V) {
+		if !keep(id) {
+			drop = append(drop, id)
+		}
+	})
+	for _, id := range drop {
+		t.table.Delete(id)
+	}
+	t.dirty = t.dirty || len(drop) > 0
+}
+
+// remapped returns the table for the stringids of generation, whose ids are
+// the ones in remap. Ids remap does not have are dropped.
+func (t *idTable[V]) remapped(remap map[uint32]uint32, stringidsGeneration uint64) *idTable[V] {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	nt := &idTable[V]{path: t.path, magic: t.magic, values: t.values, stringidsGeneration: stringidsGeneration, extra: t.extra}
+	nt.Clear()
+	t.table.ForAll(func(id uint32, v V) {
+		if newId, found := remap[id]; found {
+			nt.table.Put(newId, v)
+		}
+	})
+	return nt
+}
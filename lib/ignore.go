@@ -0,0 +1,199 @@
+package lib
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+/*
+ Ignorer decides which paths stay out of the index, following the rules of
+ gitignore: patterns are read from .gitignore and .ignore files in every
+ directory and from .pathsearchignore at the root, on top of the global
+ exclude list from the config. Patterns of deeper directories come later and
+ the last pattern that matches a path decides, a leading ! re-includes what
+ an earlier pattern excluded. A pattern with a slash other than a trailing one
+ is anchored to the directory of its file, others match the name at any
+ depth, and a trailing slash matches directories only.
+
+ Ignored directories are not descended into at all, as with git a file
+ cannot be re-included if a directory above it is excluded.
+*/
+
+var ignoreFiles = []string{".gitignore", ".ignore"}
+
+const rootIgnoreFile = ".pathsearchignore"
+
+var defaultExclude = []string{".git/", ".hg/", ".svn/", "*.class"}
+
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	// whether re matches the path relative to base or just the name
+	anchored bool
+	base     string
+}
+
+type Ignorer struct {
+	patterns []ignorePattern
+}
+
+// With returns an Ignorer that applies lines, read from a file in base,
+// after the patterns of ig. ig itself is left alone so it can be shared by
+// sibling directories.
+func (ig *Ignorer) With(base string, lines []string) *Ignorer {
+	if len(lines) == 0 {
+		return ig
+	}
+	child := &Ignorer{}
+	if ig != nil {
+		child.patterns = append(child.patterns, ig.patterns...)
+	}
+	for _, line := range lines {
+		if p, ok := parseIgnorePattern(base, line); ok {
+			child.patterns = append(child.patterns, p)
+		}
+	}
+	return child
+}
+
+func (ig *Ignorer) Ignored(path string, isDir bool) bool {
+	if ig == nil {
+		return false
+	}
+	ignored := false
+	for _, p := range ig.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.negate != ignored {
+			// cannot change the outcome
+			continue
+		}
+		if p.matches(path) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+func (p *ignorePattern) matches(path string) bool {
+	if !p.anchored {
+		return p.re.MatchString(filepath.Base(path))
+	}
+	if !underRoot(path, p.base) || path == p.base {
+		return false
+	}
+	rel := strings.TrimPrefix(path[len(p.base):], "/")
+	return p.re.MatchString(rel)
+}
+
+func parseIgnorePattern(base, line string) (ignorePattern, bool) {
+	p := ignorePattern{base: base}
+	line = trimTrailingSpaces(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return p, false
+	}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return p, false
+	}
+	p.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	re, err := regexp.Compile("^" + globToRegexp(line) + "$")
+	if err != nil {
+		return p, false
+	}
+	p.re = re
+	return p, true
+}
+
+// trimTrailingSpaces drops trailing spaces unless they are escaped.
+func trimTrailingSpaces(line string) string {
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	return line
+}
+
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			// zero or more directories
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			// everything inside
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// readIgnoreFiles returns the patterns of the ignore files among names, the
+// entries of dir.
+func readIgnoreFiles(dir string, names []string, isRoot bool) []string {
+	lines := make([]string, 0)
+	for _, name := range names {
+		if !isIgnoreFile(name, isRoot) {
+			continue
+		}
+		bs, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		lines = append(lines, strings.Split(strings.ReplaceAll(string(bs), "\r\n", "\n"), "\n")...)
+	}
+	return lines
+}
+
+func isIgnoreFile(name string, isRoot bool) bool {
+	if isRoot && name == rootIgnoreFile {
+		return true
+	}
+	for _, f := range ignoreFiles {
+		if name == f {
+			return true
+		}
+	}
+	return false
+}
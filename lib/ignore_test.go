@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnorerPatterns(t *testing.T) {
+	ig := (&Ignorer{}).With("/r", []string{
+		"# comment",
+		"*.log",
+		"!keep.log",
+		"build/",
+		"/top",
+		"docs/**/*.tmp",
+		"**/gen",
+		"data/[a-c]?.bin",
+	})
+	cases := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"/r/x.log", false, true},
+		{"/r/sub/x.log", false, true},
+		{"/r/sub/keep.log", false, false},
+		{"/r/build", true, true},
+		{"/r/sub/build", true, true},
+		{"/r/build", false, false},
+		{"/r/top", false, true},
+		{"/r/sub/top", false, false},
+		{"/r/docs/a/b/c.tmp", false, true},
+		{"/r/docs/c.tmp", false, true},
+		{"/r/other/c.tmp", false, false},
+		{"/r/a/b/gen", true, true},
+		{"/r/data/b1.bin", false, true},
+		{"/r/data/d1.bin", false, false},
+		{"/r/comment", false, false},
+	}
+	for _, c := range cases {
+		if ig.Ignored(c.path, c.isDir) != c.ignored {
+			t.Errorf("%s (dir %v): expected ignored %v", c.path, c.isDir, c.ignored)
+		}
+	}
+}
+
+func TestIgnorerNestedFilesOverrideParents(t *testing.T) {
+	ig := (&Ignorer{}).With("/r", []string{"*.gen"})
+	child := ig.With("/r/sub", []string{"!*.gen", "/local"})
+	if !ig.Ignored("/r/sub/a.gen", false) {
+		t.Error("parent patterns changed by child")
+	}
+	if child.Ignored("/r/sub/a.gen", false) {
+		t.Error("child negation not applied")
+	}
+	if !child.Ignored("/r/sub/local", false) || child.Ignored("/r/local", false) {
+		t.Error("child pattern not anchored to its directory")
+	}
+}
+
+func TestDirTreeHonorsIgnoreFiles(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	kept := filepath.Join(root, "src", "main.go")
+	touch(t, kept)
+	touch(t, filepath.Join(root, "node_modules", "dep", "index.js"))
+	touch(t, filepath.Join(root, "src", "gen", "out.go"))
+	touch(t, filepath.Join(root, "Main.class"))
+	touch(t, filepath.Join(root, ".git", "HEAD"))
+	writeFile(t, filepath.Join(root, ".gitignore"), "node_modules/\n")
+	writeFile(t, filepath.Join(root, "src", ".ignore"), "gen/\n")
+
+	tree := LoadDirTree(filepath.Join(dir, "tree"), defaultExclude)
+	added, _, _ := scanTree(t, tree, root)
+	expected := []string{kept, filepath.Join(root, ".gitignore"), filepath.Join(root, "src", ".ignore")}
+	if !sameStrings(added, expected) {
+		t.Errorf("expected %v but got %v", expected, added)
+	}
+	if _, found := tree.dirs[filepath.Join(root, "node_modules")]; found {
+		t.Error("ignored directory was descended into")
+	}
+}
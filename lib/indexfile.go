@@ -0,0 +1,307 @@
+package lib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+
+	"github.com/pankajroark/pathsearch/ds"
+)
+
+/*
+ The index is stored in segments, files laid out so that they can be mapped
+ into memory and queried where they are, without decoding them first. Several
+ servers opening the same file share its pages through the page cache. How
+ segments are stacked is described in segments.go.
+
+	header:
+	  magic        "PSIX"
+	  version      uint32
+	  count        uint32, of trigrams
+	  checksum     uint32, crc32c of the dictionary, keys and dead
+	  keys length  uint64
+	  postings length uint64
+	  dead length  uint64
+	dictionary: count entries sorted by trigram, each
+	  key offset     uint32, into keys
+	  key length     uint32
+	  posting offset uint64, into postings
+	  posting checksum uint32, crc32c of the posting list
+	keys:     the trigrams, concatenated
+	postings: the PostingLists, concatenated
+	dead:     a PostingList of the ids deleted from older segments
+
+ A posting list ends where the next one starts. Trigrams are usually three
+ bytes but lowercasing can make them longer, hence the separate keys.
+
+ Anything that does not check out, a different magic or version, a short
+ file or a checksum mismatch, is an error for the caller to recover from by
+ indexing again. Only the dictionary, keys and dead ids are verified at open,
+ the postings, which make up most of the file, are not read then. Each posting
+ list is verified the first time it is used instead. One that does not match
+ its checksum is treated as empty and marks the segment corrupt, the server
+ then indexes again from scratch. Files are replaced with a rename so a
+ crash leaves either the old or the new file behind, never half of one.
+*/
+
+const (
+	indexMagic       = "PSIX"
+	indexVersion     = 4
+	indexHeaderSize  = 4 + 4 + 4 + 4 + 8 + 8 + 8
+	segmentEntrySize = 4 + 4 + 8 + 4
+)
+
+var (
+	errIndexMagic     = errors.New("not an index file")
+	errIndexChecksum  = errors.New("index checksum mismatch")
+	errIndexTruncated = errors.New("truncated index file")
+	errIndexCorrupt   = errors.New("corrupt index dictionary")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Segment is a read only index, usually mapped from a file.
+type Segment struct {
+	// base name of the file, empty if seg was not read from one
+	name     string
+	size     int
+	count    int
+	dict     []byte
+	keys     []byte
+	postings []byte
+	dead     map[uint32]bool
+	unmap    func() error
+	// a bit per posting list that matched its checksum
+	verified []uint32
+	// set once a posting list did not
+	corrupt atomic.Bool
+	// the snapshots using seg, see retain
+	refs atomic.Int32
+}
+
+// encodeIndexFile returns a segment holding idx, dead must be sorted.
+func encodeIndexFile(idx map[string]PostingList, dead []uint32) ([]byte, error) {
+	trigrams := make([]string, 0, len(idx))
+	keysLen, postingsLen := 0, 0
+	for trigram, pl := range idx {
+		if pl.Len() == 0 {
+			continue
+		}
+		trigrams = append(trigrams, trigram)
+		keysLen += len(trigram)
+		postingsLen += len(pl)
+	}
+	if uint64(keysLen) > 1<<32-1 {
+		return nil, errors.New("too many trigrams for an index file")
+	}
+	sort.Strings(trigrams)
+
+	deadList := EncodePostings(dead)
+	dictLen := len(trigrams) * segmentEntrySize
+	bs := make([]byte, indexHeaderSize+dictLen+keysLen+postingsLen+len(deadList))
+	copy(bs, indexMagic)
+	binary.LittleEndian.PutUint32(bs[4:8], indexVersion)
+	binary.LittleEndian.PutUint32(bs[8:12], uint32(len(trigrams)))
+	binary.LittleEndian.PutUint64(bs[16:24], uint64(keysLen))
+	binary.LittleEndian.PutUint64(bs[24:32], uint64(postingsLen))
+	binary.LittleEndian.PutUint64(bs[32:40], uint64(len(deadList)))
+	dict := bs[indexHeaderSize : indexHeaderSize+dictLen]
+	keys := bs[indexHeaderSize+dictLen : indexHeaderSize+dictLen+keysLen]
+	postings := bs[indexHeaderSize+dictLen+keysLen : indexHeaderSize+dictLen+keysLen+postingsLen]
+	copy(bs[indexHeaderSize+dictLen+keysLen+postingsLen:], deadList)
+	keyOff, postingOff := 0, 0
+	for i, trigram := range trigrams {
+		entry := dict[i*segmentEntrySize:]
+		binary.LittleEndian.PutUint32(entry[0:4], uint32(keyOff))
+		binary.LittleEndian.PutUint32(entry[4:8], uint32(len(trigram)))
+		binary.LittleEndian.PutUint64(entry[8:16], uint64(postingOff))
+		binary.LittleEndian.PutUint32(entry[16:20], crc32.Checksum(idx[trigram], castagnoli))
+		keyOff += copy(keys[keyOff:], trigram)
+		postingOff += copy(postings[postingOff:], idx[trigram])
+	}
+	crc := crc32.Checksum(bs[indexHeaderSize:indexHeaderSize+dictLen+keysLen], castagnoli)
+	binary.LittleEndian.PutUint32(bs[12:16], crc32.Update(crc, castagnoli, deadList))
+	return bs, nil
+}
+
+// decodeIndexFile checks bs and returns a segment referencing it.
+func decodeIndexFile(bs []byte) (*Segment, error) {
+	if len(bs) < indexHeaderSize {
+		return nil, errIndexTruncated
+	}
+	if string(bs[:4]) != indexMagic {
+		return nil, errIndexMagic
+	}
+	if version := binary.LittleEndian.Uint32(bs[4:8]); version != indexVersion {
+		return nil, fmt.Errorf("unsupported index version %d", version)
+	}
+	count := uint64(binary.LittleEndian.Uint32(bs[8:12]))
+	keysLen := binary.LittleEndian.Uint64(bs[16:24])
+	postingsLen := binary.LittleEndian.Uint64(bs[24:32])
+	deadLen := binary.LittleEndian.Uint64(bs[32:40])
+	body := bs[indexHeaderSize:]
+	dictLen := count * segmentEntrySize
+	if keysLen > uint64(len(body)) || postingsLen > uint64(len(body)) || deadLen > uint64(len(body)) ||
+		dictLen+keysLen+postingsLen+deadLen != uint64(len(body)) {
+		return nil, errIndexTruncated
+	}
+	deadList := body[dictLen+keysLen+postingsLen:]
+	crc := crc32.Checksum(body[:dictLen+keysLen], castagnoli)
+	if crc32.Update(crc, castagnoli, deadList) != binary.LittleEndian.Uint32(bs[12:16]) {
+		return nil, errIndexChecksum
+	}
+	seg := &Segment{
+		size:     len(bs),
+		count:    int(count),
+		dict:     body[:dictLen],
+		keys:     body[dictLen : dictLen+keysLen],
+		postings: body[dictLen+keysLen : dictLen+keysLen+postingsLen],
+		dead:     make(map[uint32]bool),
+		verified: make([]uint32, (count+31)/32),
+	}
+	it := PostingList(deadList).Iterator()
+	for id, ok := it.Next(); ok; id, ok = it.Next() {
+		seg.dead[id] = true
+	}
+	// bounds are checked once here so lookups do not have to
+	prevKey, prevOff := "", uint64(0)
+	for i := 0; i < seg.count; i++ {
+		entry := seg.dict[i*segmentEntrySize:]
+		keyOff := uint64(binary.LittleEndian.Uint32(entry[0:4]))
+		keyLen := uint64(binary.LittleEndian.Uint32(entry[4:8]))
+		off := binary.LittleEndian.Uint64(entry[8:16])
+		if keyOff+keyLen > keysLen || off < prevOff || off > postingsLen {
+			return nil, errIndexCorrupt
+		}
+		key := string(seg.keys[keyOff : keyOff+keyLen])
+		if i > 0 && key <= prevKey {
+			return nil, errIndexCorrupt
+		}
+		prevKey, prevOff = key, off
+	}
+	return seg, nil
+}
+
+// OpenSegment maps the index file at path. The mapping is released by Close,
+// posting lists taken from the segment must not be used after.
+func OpenSegment(path string) (*Segment, error) {
+	bs, unmap, err := ds.MapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seg, err := decodeIndexFile(bs)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	seg.name = filepath.Base(path)
+	seg.unmap = unmap
+	return seg, nil
+}
+
+// Close unmaps the file seg was opened from.
+func (seg *Segment) Close() error {
+	if seg.unmap == nil {
+		return nil
+	}
+	err := seg.unmap()
+	seg.unmap = nil
+	return err
+}
+
+// retain adds a snapshot using seg.
+func (seg *Segment) retain() {
+	seg.refs.Add(1)
+}
+
+// release drops a snapshot using seg, the last one to go closes it.
+func (seg *Segment) release() {
+	if seg.refs.Add(-1) == 0 {
+		if err := seg.Close(); err != nil {
+			log.Printf("failed to unmap segment %s: %v", seg.name, err)
+		}
+	}
+}
+
+// closeSegments closes segs that were never published.
+func closeSegments(segs []*Segment) {
+	for _, seg := range segs {
+		seg.Close()
+	}
+}
+
+// Corrupt reports whether a posting list of seg did not match its checksum.
+func (seg *Segment) Corrupt() bool {
+	return seg.corrupt.Load()
+}
+
+// Len returns the number of trigrams in seg, which may be nil.
+func (seg *Segment) Len() int {
+	if seg == nil {
+		return 0
+	}
+	return seg.count
+}
+
+func (seg *Segment) key(i int) []byte {
+	entry := seg.dict[i*segmentEntrySize:]
+	off := binary.LittleEndian.Uint32(entry[0:4])
+	return seg.keys[off : off+binary.LittleEndian.Uint32(entry[4:8])]
+}
+
+// postingList returns the i'th posting list, nil if it does not match its
+// checksum.
+func (seg *Segment) postingList(i int) PostingList {
+	entry := seg.dict[i*segmentEntrySize:]
+	start := binary.LittleEndian.Uint64(entry[8:16])
+	end := uint64(len(seg.postings))
+	if i+1 < seg.count {
+		end = binary.LittleEndian.Uint64(seg.dict[(i+1)*segmentEntrySize+8:])
+	}
+	pl := seg.postings[start:end:end]
+	word, bit := &seg.verified[i/32], uint32(1)<<(i%32)
+	if atomic.LoadUint32(word)&bit == 0 {
+		if crc32.Checksum(pl, castagnoli) != binary.LittleEndian.Uint32(entry[16:20]) {
+			if seg.corrupt.CompareAndSwap(false, true) {
+				log.Printf("segment %s: %v for %q", seg.name, errIndexChecksum, seg.key(i))
+			}
+			return nil
+		}
+		for old := atomic.LoadUint32(word); !atomic.CompareAndSwapUint32(word, old, old|bit); {
+			old = atomic.LoadUint32(word)
+		}
+	}
+	return PostingList(pl)
+}
+
+// Postings returns the posting list of trigram, nil if seg has none.
+func (seg *Segment) Postings(trigram string) PostingList {
+	if seg == nil {
+		return nil
+	}
+	i := sort.Search(seg.count, func(i int) bool { return string(seg.key(i)) >= trigram })
+	if i == seg.count || string(seg.key(i)) != trigram {
+		return nil
+	}
+	return seg.postingList(i)
+}
+
+// Dead reports whether seg deletes id from the segments below it.
+func (seg *Segment) Dead(id uint32) bool {
+	return seg != nil && seg.dead[id]
+}
+
+// ForEach calls f with every trigram of seg and its posting list, leaving out
+// the posting lists that do not match their checksum.
+func (seg *Segment) ForEach(f func(trigram string, pl PostingList)) {
+	for i := 0; i < seg.Len(); i++ {
+		if pl := seg.postingList(i); pl != nil {
+			f(string(seg.key(i)), pl)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package lib
+
+import "testing"
+
+func TestIndexFileRoundTrip(t *testing.T) {
+	idx := EncodeIndex(map[string][]uint32{"abc": {1, 5}, "bcd": {5}})
+	bs, err := encodeIndexFile(idx, []uint32{2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeIndexFile(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Len() != 2 || !compareSlices(decoded.Postings("abc").Decode(), []uint32{1, 5}) ||
+		!compareSlices(decoded.Postings("bcd").Decode(), []uint32{5}) {
+		t.Errorf("unexpected segment with %d trigrams", decoded.Len())
+	}
+	if decoded.Postings("xyz") != nil || decoded.Postings("") != nil {
+		t.Errorf("found a trigram that is not in the segment")
+	}
+	if !decoded.Dead(2) || !decoded.Dead(3) || decoded.Dead(1) {
+		t.Errorf("unexpected dead ids %v", decoded.dead)
+	}
+
+	empty, err := encodeIndexFile(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err := decodeIndexFile(empty); err != nil || decoded.Len() != 0 {
+		t.Errorf("expected an empty segment but got %v", err)
+	}
+}
+
+func TestIndexFileCorruption(t *testing.T) {
+	bs, err := encodeIndexFile(EncodeIndex(map[string][]uint32{"abc": {1, 5}}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipped := append([]byte(nil), bs...)
+	flipped[len(flipped)-1] ^= 1
+	dict := append([]byte(nil), bs...)
+	dict[indexHeaderSize] ^= 1
+	newer := append([]byte(nil), bs...)
+	newer[4] = indexVersion + 1
+	cases := map[string][]byte{
+		"empty":     nil,
+		"truncated": bs[:len(bs)-1],
+		"flipped":   flipped,
+		"dict":      dict,
+		"version":   newer,
+		"headless":  bs[indexHeaderSize:],
+	}
+	for name, bs := range cases {
+		if _, err := decodeIndexFile(bs); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestIndexFilePostingCorruption(t *testing.T) {
+	bs, err := encodeIndexFile(EncodeIndex(map[string][]uint32{"abc": {1, 5}, "bcd": {5}}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first byte of the posting list of abc
+	bs[indexHeaderSize+2*segmentEntrySize+6] ^= 1
+	seg, err := decodeIndexFile(bs)
+	if err != nil {
+		t.Fatalf("expected posting lists to be verified when used but got %v", err)
+	}
+	if seg.Corrupt() {
+		t.Error("corrupt before the posting list was used")
+	}
+	if got := seg.Postings("bcd").Decode(); !compareSlices(got, []uint32{5}) || seg.Corrupt() {
+		t.Errorf("expected [5] from the intact posting list but got %v", got)
+	}
+	if pl := seg.Postings("abc"); pl != nil || !seg.Corrupt() {
+		t.Errorf("expected the corrupt posting list to be left out but got %d bytes", len(pl))
+	}
+	trigrams := make([]string, 0)
+	seg.ForEach(func(trigram string, pl PostingList) {
+		trigrams = append(trigrams, trigram)
+	})
+	if len(trigrams) != 1 || trigrams[0] != "bcd" {
+		t.Errorf("expected only bcd but got %v", trigrams)
+	}
+}
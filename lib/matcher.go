@@ -6,16 +6,31 @@ import (
 	"strings"
 )
 
+// candidate is a path that shares enough trigrams with the query, with its
+// metadata if there is any and how often and lately it was visited.
+type candidate struct {
+	path     string
+	meta     FileMeta
+	frecency float64
+}
+
 type candscor struct {
-	cand  string
+	cand  candidate
 	score int
 }
 
 type ByScore []candscor
 
-func (a ByScore) Len() int           { return len(a) }
-func (a ByScore) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a ByScore) Less(i, j int) bool { return a[i].score < a[j].score }
+func (a ByScore) Len() int      { return len(a) }
+func (a ByScore) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+
+// Of equally good matches the most recently modified file comes first.
+func (a ByScore) Less(i, j int) bool {
+	if a[i].score != a[j].score {
+		return a[i].score < a[j].score
+	}
+	return a[i].cand.meta.Mtime > a[j].cand.meta.Mtime
+}
 
 // todo return a clone
 func reverse(ss []string) {
@@ -27,7 +42,7 @@ func reverse(ss []string) {
 
 // Query will have the reverse form of the bath
 // i.e. filequery/dir
-func match(cands []string, query string) []string {
+func match(cands []candidate, query string) []string {
 	qparts := strings.Split(query, "/")
 	//qfilepart := qparts[len(qparts)-1]
 	qfilepart := qparts[0]
@@ -47,10 +62,15 @@ func match(cands []string, query string) []string {
 		top = rank(top, revQuery, identityExtractor)
 	}
 	// Pick smaller number from the large set based on full match
-	return uptoN(top, 10)
+	top = uptoN(top, 10)
+	paths := make([]string, 0, len(top))
+	for _, cand := range top {
+		paths = append(paths, cand.path)
+	}
+	return paths
 }
 
-func uptoN(slice []string, n int) []string {
+func uptoN(slice []candidate, n int) []candidate {
 	if len(slice) > n {
 		return slice[:n]
 	} else {
@@ -58,19 +78,19 @@ func uptoN(slice []string, n int) []string {
 	}
 }
 
-func rank(cands []string, fuzz string, candExtractor func(string) string) []string {
+func rank(cands []candidate, fuzz string, candExtractor func(string) string) []candidate {
 	// assign a score to each candidate
 	// sort by them
 	candscores := make([]candscor, 0)
 	for _, cand := range cands {
-		basecand := candExtractor(cand)
-		score := score(basecand, fuzz)
+		basecand := candExtractor(cand.path)
+		score := score(basecand, fuzz) - frecencyBonus(cand.frecency)
 		cs := candscor{cand: cand, score: score}
 		//fmt.Println(cs)
 		candscores = append(candscores, cs)
 	}
 	sort.Sort(ByScore(candscores))
-	ret := make([]string, 0)
+	ret := make([]candidate, 0)
 	for _, cs := range candscores {
 		//fmt.Println(cs)
 		ret = append(ret, cs.cand)
@@ -0,0 +1,245 @@
+package lib
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+/*
+ PostingList is a sorted list of path ids, compressed. Ids are split in
+ blocks of postingBlockSize, within a block every id is stored as the varint
+ delta from the one before it. A skip table in front holds the first id and
+ the byte length of every block, so a reader can jump over whole blocks
+ without decoding them.
+
+	uvarint count
+	uvarint length of the skip table in bytes
+	skip table: per block, uvarint first id as delta from the previous
+	            block's first id, uvarint length of the block in bytes
+	blocks:     per block, uvarint deltas of all ids but the first
+
+ Lists are decoded lazily through a PostingIterator, nothing is materialized
+ to answer a query.
+*/
+
+type PostingList []byte
+
+const postingBlockSize = 128
+
+// EncodePostings compresses ids, which must be sorted and unique.
+func EncodePostings(ids []uint32) PostingList {
+	skip := make([]byte, 0)
+	blocks := make([]byte, 0, len(ids))
+	prevFirst := uint32(0)
+	for start := 0; start < len(ids); start += postingBlockSize {
+		end := start + postingBlockSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		blockStart := len(blocks)
+		prev := ids[start]
+		for _, id := range ids[start+1 : end] {
+			blocks = binary.AppendUvarint(blocks, uint64(id-prev))
+			prev = id
+		}
+		skip = binary.AppendUvarint(skip, uint64(ids[start]-prevFirst))
+		skip = binary.AppendUvarint(skip, uint64(len(blocks)-blockStart))
+		prevFirst = ids[start]
+	}
+	pl := binary.AppendUvarint(nil, uint64(len(ids)))
+	pl = binary.AppendUvarint(pl, uint64(len(skip)))
+	pl = append(pl, skip...)
+	return append(pl, blocks...)
+}
+
+func (pl PostingList) Len() int {
+	count, _ := binary.Uvarint(pl)
+	return int(count)
+}
+
+// Decode returns all ids in the list.
+func (pl PostingList) Decode() []uint32 {
+	ids := make([]uint32, 0, pl.Len())
+	it := pl.Iterator()
+	for id, ok := it.Next(); ok; id, ok = it.Next() {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+type PostingIterator struct {
+	pl PostingList
+	// ids in the blocks not loaded yet
+	left int
+	// offsets of the next skip table entry, of its end and of the next block
+	skip, skipEnd, data int
+	first               uint32
+	// the current block
+	pos     int
+	inBlock int
+	cur     uint32
+	valid   bool
+}
+
+func (pl PostingList) Iterator() *PostingIterator {
+	it := &PostingIterator{pl: pl}
+	if len(pl) == 0 {
+		return it
+	}
+	count, n := binary.Uvarint(pl)
+	skipLen, m := binary.Uvarint(pl[n:])
+	it.left = int(count)
+	it.skip = n + m
+	it.skipEnd = it.skip + int(skipLen)
+	it.data = it.skipEnd
+	return it
+}
+
+// peek returns the first id and the byte length of the next block.
+func (it *PostingIterator) peek() (first uint32, length, n int) {
+	delta, a := binary.Uvarint(it.pl[it.skip:])
+	size, b := binary.Uvarint(it.pl[it.skip+a:])
+	return it.first + uint32(delta), int(size), a + b
+}
+
+// nextBlock moves to the start of the next block, skipping whatever is left
+// of the current one.
+func (it *PostingIterator) nextBlock() bool {
+	if it.left == 0 || it.skip >= it.skipEnd {
+		it.valid = false
+		return false
+	}
+	first, length, n := it.peek()
+	it.skip += n
+	it.first = first
+	it.pos = it.data
+	it.data += length
+	it.inBlock = postingBlockSize
+	if it.left < postingBlockSize {
+		it.inBlock = it.left
+	}
+	it.left -= it.inBlock
+	it.inBlock--
+	it.cur = first
+	it.valid = true
+	return true
+}
+
+// Next returns the next id, ok is false once the list is exhausted.
+func (it *PostingIterator) Next() (id uint32, ok bool) {
+	if it.inBlock == 0 {
+		if !it.nextBlock() {
+			return 0, false
+		}
+		return it.cur, true
+	}
+	delta, n := binary.Uvarint(it.pl[it.pos:])
+	it.pos += n
+	it.inBlock--
+	it.cur += uint32(delta)
+	return it.cur, true
+}
+
+// Advance returns the first id not smaller than target at or after the
+// current position, skipping blocks that end before target.
+func (it *PostingIterator) Advance(target uint32) (id uint32, ok bool) {
+	if it.valid && it.cur >= target {
+		return it.cur, true
+	}
+	for it.left > 0 && it.skip < it.skipEnd {
+		if first, _, _ := it.peek(); first > target {
+			break
+		}
+		it.nextBlock()
+	}
+	if it.valid && it.cur >= target {
+		return it.cur, true
+	}
+	for id, ok = it.Next(); ok && id < target; id, ok = it.Next() {
+	}
+	return id, ok
+}
+
+// IntersectPostings returns the ids in both a and b.
+func IntersectPostings(a, b PostingList) []uint32 {
+	if a.Len() > b.Len() {
+		a, b = b, a
+	}
+	ids := make([]uint32, 0)
+	ita, itb := a.Iterator(), b.Iterator()
+	id, ok := ita.Next()
+	for ok {
+		other, found := itb.Advance(id)
+		if !found {
+			break
+		}
+		if other == id {
+			ids = append(ids, id)
+			id, ok = ita.Next()
+		} else {
+			id, ok = ita.Advance(other)
+		}
+	}
+	return ids
+}
+
+func EncodeIndex(idx map[string][]uint32) map[string]PostingList {
+	encoded := make(map[string]PostingList, len(idx))
+	for trigram, paths := range idx {
+		if !sort.IsSorted(UInt32ByValue(paths)) {
+			paths = append([]uint32(nil), paths...)
+			sort.Sort(UInt32ByValue(paths))
+		}
+		encoded[trigram] = EncodePostings(paths)
+	}
+	return encoded
+}
+
+func DecodeIndex(idx map[string]PostingList) map[string][]uint32 {
+	decoded := make(map[string][]uint32, len(idx))
+	for trigram, pl := range idx {
+		decoded[trigram] = pl.Decode()
+	}
+	return decoded
+}
+
+// PostingIds returns the set of ids that appear in any posting list of idx.
+func PostingIds(idx map[string]PostingList) map[uint32]bool {
+	ids := make(map[uint32]bool)
+	for _, pl := range idx {
+		it := pl.Iterator()
+		for id, ok := it.Next(); ok; id, ok = it.Next() {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// UpdatePostings is UpdateIndex for compressed posting lists, only the
+// touched lists are decoded and encoded again.
+func UpdatePostings(idx map[string]PostingList, dead map[uint32]bool, deadTrigrams map[string]bool, added map[string][]uint32) map[string]PostingList {
+	touched := make(map[string][]uint32)
+	for trigram := range deadTrigrams {
+		if pl, found := idx[trigram]; found {
+			touched[trigram] = pl.Decode()
+		}
+	}
+	for trigram := range added {
+		if pl, found := idx[trigram]; found {
+			touched[trigram] = pl.Decode()
+		}
+	}
+	updated := UpdateIndex(touched, dead, deadTrigrams, added)
+
+	newIdx := make(map[string]PostingList, len(idx))
+	for trigram, pl := range idx {
+		newIdx[trigram] = pl
+	}
+	for trigram := range touched {
+		delete(newIdx, trigram)
+	}
+	for trigram, paths := range updated {
+		newIdx[trigram] = EncodePostings(paths)
+	}
+	return newIdx
+}
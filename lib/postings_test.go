@@ -0,0 +1,157 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func randomIds(r *rand.Rand, n int, max uint32) []uint32 {
+	seen := make(map[uint32]bool)
+	for len(seen) < n {
+		seen[uint32(r.Int63n(int64(max)))] = true
+	}
+	ids := make([]uint32, 0, n)
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Sort(UInt32ByValue(ids))
+	return ids
+}
+
+func TestPostingsRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 2, postingBlockSize - 1, postingBlockSize, postingBlockSize + 1, 1000} {
+		ids := randomIds(r, n, 1<<32-1)
+		pl := EncodePostings(ids)
+		if pl.Len() != n {
+			t.Errorf("expected %d but got %d", n, pl.Len())
+		}
+		if decoded := pl.Decode(); !compareSlices(decoded, ids) {
+			t.Errorf("expected %v but got %v", ids, decoded)
+		}
+	}
+}
+
+func TestPostingsAdvance(t *testing.T) {
+	ids := make([]uint32, 0)
+	for i := uint32(0); i < 1000; i++ {
+		ids = append(ids, i*3)
+	}
+	pl := EncodePostings(ids)
+	it := pl.Iterator()
+	for _, target := range []uint32{0, 1, 400, 401, 1500, 2997} {
+		expected := (target + 2) / 3 * 3
+		id, ok := it.Advance(target)
+		if !ok || id != expected {
+			t.Errorf("expected %d but got %d", expected, id)
+		}
+	}
+	if _, ok := it.Advance(2998); ok {
+		t.Errorf("expected the list to be exhausted")
+	}
+	// advancing does not skip the id it stopped at
+	it = pl.Iterator()
+	it.Advance(600)
+	if id, _ := it.Next(); id != 603 {
+		t.Errorf("expected 603 but got %d", id)
+	}
+}
+
+func TestIntersectPostings(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	xs := randomIds(r, 5000, 20000)
+	ys := randomIds(r, 300, 20000)
+	expected := make([]uint32, 0)
+	for _, y := range ys {
+		i := sort.Search(len(xs), func(i int) bool { return xs[i] >= y })
+		if i < len(xs) && xs[i] == y {
+			expected = append(expected, y)
+		}
+	}
+	got := IntersectPostings(EncodePostings(xs), EncodePostings(ys))
+	if !compareSlices(got, expected) {
+		t.Errorf("expected %v but got %v", expected, got)
+	}
+}
+
+func TestUpdatePostings(t *testing.T) {
+	idx := EncodeIndex(map[string][]uint32{"abc": {1, 2, 3}, "bcd": {2}, "cde": {3}})
+	dead := map[uint32]bool{2: true}
+	deadTrigrams := map[string]bool{"abc": true, "bcd": true}
+	updated := UpdatePostings(idx, dead, deadTrigrams, map[string][]uint32{"cde": {4}})
+	if _, found := updated["bcd"]; found {
+		t.Errorf("expected bcd to be dropped")
+	}
+	if got := updated["abc"].Decode(); !compareSlices(got, []uint32{1, 3}) {
+		t.Errorf("expected [1 3] but got %v", got)
+	}
+	if got := updated["cde"].Decode(); !compareSlices(got, []uint32{3, 4}) {
+		t.Errorf("expected [3 4] but got %v", got)
+	}
+	if got := idx["abc"].Decode(); !compareSlices(got, []uint32{1, 2, 3}) {
+		t.Errorf("expected the original index to be untouched but got %v", got)
+	}
+}
+
+// benchIndex looks roughly like the index of a large tree: many trigrams
+// with short posting lists and a few common ones with long lists.
+func benchIndex() map[string][]uint32 {
+	r := rand.New(rand.NewSource(3))
+	const paths = 1 << 20
+	idx := make(map[string][]uint32)
+	for i := 0; i < 20000; i++ {
+		n := 1 + int(r.ExpFloat64()*50)
+		if i%1000 == 0 {
+			n = 50000
+		}
+		idx[string([]byte{byte(i >> 16), byte(i >> 8), byte(i)})] = randomIds(r, n, paths)
+	}
+	return idx
+}
+
+func gobBytes(b *testing.B, v interface{}) []byte {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		b.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkLoadIndexGob(b *testing.B) {
+	bs := gobBytes(b, benchIndex())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var idx map[string][]uint32
+		if err := gob.NewDecoder(bytes.NewBuffer(bs)).Decode(&idx); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(bs)), "bytes")
+}
+
+func BenchmarkLoadIndexPostings(b *testing.B) {
+	bs := gobBytes(b, EncodeIndex(benchIndex()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var idx map[string]PostingList
+		if err := gob.NewDecoder(bytes.NewBuffer(bs)).Decode(&idx); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(bs)), "bytes")
+}
+
+func BenchmarkIteratePostings(b *testing.B) {
+	idx := EncodeIndex(benchIndex())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, pl := range idx {
+			it := pl.Iterator()
+			for _, ok := it.Next(); ok; _, ok = it.Next() {
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pankajroark/pathsearch/ds"
+)
+
+// The roots file lives next to the index and holds one root per line.
+
+func ReadRoots(path string) ([]string, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	roots := make([]string, 0)
+	for _, line := range strings.Split(string(bs), "\n") {
+		if line == "" {
+			continue
+		}
+		root, err := absRoot(line)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+func WriteRoots(path string, roots []string) error {
+	var b strings.Builder
+	for _, root := range roots {
+		b.WriteString(root)
+		b.WriteString("\n")
+	}
+	// a crash while writing must not leave some of the roots behind
+	return ds.WriteFileAtomic(path, []byte(b.String()), 0644)
+}
+
+// absRoot returns root as roots are kept and compared, absolute and clean.
+func absRoot(root string) (string, error) {
+	return filepath.Abs(expandHome(root))
+}
+
+// ValidateRoot cleans up root and checks that it is an existing directory.
+func ValidateRoot(root string) (string, error) {
+	if root == "" {
+		return "", errors.New("root must not be empty")
+	}
+	abs, err := absRoot(root)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", abs)
+	}
+	return abs, nil
+}
+
+// underRoot reports whether path is root itself or lies inside it.
+func underRoot(path, root string) bool {
+	if path == root {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(root, "/")+"/")
+}
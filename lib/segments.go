@@ -0,0 +1,469 @@
+package lib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+ The index is a stack of immutable segments, oldest first, and a small
+ in-memory table on top. Changes only ever go to the table: added paths are
+ merged into its posting lists and removed ones are recorded as dead ids.
+ Storing the index writes the table out as one more segment, a segment's dead
+ ids hide those ids in every segment below it.
+
+ Ids are never reused, so an id is live in the index if some segment has it
+ and no segment above that one deletes it. A path can be in more than one
+ segment, queries merge the posting lists of all segments and drop duplicates.
+
+ Segments pile up, so a compactor merges the newest ones whenever they add up
+ to at least half the size of the one below them, or when there are too many.
+ That keeps the number of segments logarithmic in the size of the index while
+ a few changed files never cause the whole index to be written again. When
+ the merge reaches the oldest segment dead ids have nothing left to hide and
+ are dropped.
+
+ Which segments make up the index is recorded in a manifest, stored at the
+ index path:
+
+	magic    "PSMF"
+	version  uint32
+	checksum uint32, crc32c of what follows
+	stringids generation uint64
+	stringids size uint64
+	names    the base names of the segment files, oldest first, one per line
+
+ Segments hold stringids ids, which only make sense for the wal they were
+ taken from. The manifest records the generation of the wal and how
+ large it was when it was written. A wal of another generation was rewritten
+ since and a smaller one lost data, the index cannot be used with either.
+
+ Queries hold on to the snapshot they started with. A snapshot counts its
+ readers, plus one while it is the published one, and lets go of the
+ segments and the stringids it uses once the count drops to zero. Segments
+ and stringids replaced by compaction are closed when the last snapshot
+ using them is done with them, posting lists point into the mapped files.
+*/
+
+const (
+	manifestMagic      = "PSMF"
+	manifestVersion    = 4
+	manifestHeaderSize = 4 + 4 + 4 + 8 + 8
+	// newer segments are merged into an older one at most this many times
+	// their size
+	compactRatio = 2
+	maxSegments  = 8
+	// stringids are compacted once more than half of them is deleted paths,
+	// unless they are smaller than this
+	stringidsCompactMin = 1 << 20
+)
+
+var errManifest = errors.New("not an index manifest")
+
+type snapshot struct {
+	// stored segments, oldest first
+	segs []*Segment
+	// posting lists of the paths added since the newest segment was stored
+	idx map[string]PostingList
+	// ids removed since the newest segment was stored
+	dead map[uint32]bool
+	// the paths the ids stand for, it changes when stringids are compacted
+	stringids *Stringids
+	// metadata and visits of the files by id, replaced along with
+	// stringids
+	meta   *MetaStore
+	visits *VisitStore
+	// readers, plus one while published, see publish
+	refs atomic.Int32
+}
+
+// acquire returns the published snapshot for reading, it must be released
+// when done.
+func (s *Server) acquire() *snapshot {
+	for {
+		if snap := s.snap.Load(); snap.tryRetain() {
+			return snap
+		}
+	}
+}
+
+// tryRetain adds a reader to snap unless it was retired and is done already.
+func (snap *snapshot) tryRetain() bool {
+	for {
+		n := snap.refs.Load()
+		if n == 0 {
+			return false
+		}
+		if snap.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// release drops a reader of snap, or the publication of it. The last one to
+// go lets go of what snap uses.
+func (snap *snapshot) release() {
+	if snap.refs.Add(-1) == 0 {
+		for _, seg := range snap.segs {
+			seg.release()
+		}
+		snap.stringids.release()
+	}
+}
+
+// publish makes snap the snapshot queries read and retires the one before.
+// It must be called with writeMu held.
+func (s *Server) publish(snap *snapshot) {
+	snap.refs.Store(1)
+	for _, seg := range snap.segs {
+		seg.retain()
+	}
+	snap.stringids.retain()
+	if old := s.snap.Swap(snap); old != nil {
+		old.release()
+	}
+}
+
+// corrupt reports whether a posting list of snap did not match its checksum,
+// snap lacks the ids in it then.
+func (snap *snapshot) corrupt() bool {
+	for _, seg := range snap.segs {
+		if seg.Corrupt() {
+			return true
+		}
+	}
+	return false
+}
+
+// live reports whether id, found in the segment at level, is not deleted by
+// any level above it. The table is level len(segs).
+func (snap *snapshot) live(id uint32, level int) bool {
+	if level >= len(snap.segs) {
+		return true
+	}
+	if snap.dead[id] {
+		return false
+	}
+	for _, seg := range snap.segs[level+1:] {
+		if seg.Dead(id) {
+			return false
+		}
+	}
+	return true
+}
+
+// forEach calls f with every live id in the posting lists of trigram, in
+// order and once each.
+func (snap *snapshot) forEach(trigram string, f func(id uint32)) {
+	its := make([]*PostingIterator, 0, len(snap.segs)+1)
+	levels := make([]int, 0, len(snap.segs)+1)
+	for level, seg := range snap.segs {
+		if pl := seg.Postings(trigram); pl != nil {
+			its = append(its, pl.Iterator())
+			levels = append(levels, level)
+		}
+	}
+	if pl, found := snap.idx[trigram]; found {
+		its = append(its, pl.Iterator())
+		levels = append(levels, len(snap.segs))
+	}
+	mergePostings(its, func(id uint32, i int) bool {
+		return snap.live(id, levels[i])
+	}, f)
+}
+
+// mergePostings is a k-way MergeSortedIntArray over its. An id is passed to f
+// if keep accepts it for at least one of the iterators it is found in.
+func mergePostings(its []*PostingIterator, keep func(id uint32, i int) bool, f func(id uint32)) {
+	heads := make([]uint32, len(its))
+	ok := make([]bool, len(its))
+	for i, it := range its {
+		heads[i], ok[i] = it.Next()
+	}
+	for {
+		min, found := uint32(0), false
+		for i := range its {
+			if ok[i] && (!found || heads[i] < min) {
+				min, found = heads[i], true
+			}
+		}
+		if !found {
+			return
+		}
+		kept := false
+		for i, it := range its {
+			if ok[i] && heads[i] == min {
+				kept = kept || keep(min, i)
+				heads[i], ok[i] = it.Next()
+			}
+		}
+		if kept {
+			f(min)
+		}
+	}
+}
+
+// trigrams returns every trigram of snap that may have live ids.
+func (snap *snapshot) trigrams() []string {
+	seen := make(map[string]bool)
+	for _, seg := range snap.segs {
+		seg.ForEach(func(trigram string, pl PostingList) {
+			seen[trigram] = true
+		})
+	}
+	for trigram := range snap.idx {
+		seen[trigram] = true
+	}
+	trigrams := make([]string, 0, len(seen))
+	for trigram := range seen {
+		trigrams = append(trigrams, trigram)
+	}
+	sort.Strings(trigrams)
+	return trigrams
+}
+
+// all returns the live posting lists of snap decoded, a fresh copy.
+func (snap *snapshot) all() map[string][]uint32 {
+	idx := make(map[string][]uint32)
+	for _, trigram := range snap.trigrams() {
+		paths := make([]uint32, 0)
+		snap.forEach(trigram, func(id uint32) {
+			paths = append(paths, id)
+		})
+		if len(paths) > 0 {
+			idx[trigram] = paths
+		}
+	}
+	return idx
+}
+
+// ids returns every live id in snap.
+func (snap *snapshot) ids() map[uint32]bool {
+	ids := make(map[uint32]bool)
+	for level, seg := range snap.segs {
+		seg.ForEach(func(trigram string, pl PostingList) {
+			it := pl.Iterator()
+			for id, ok := it.Next(); ok; id, ok = it.Next() {
+				if !ids[id] && snap.live(id, level) {
+					ids[id] = true
+				}
+			}
+		})
+	}
+	for id := range PostingIds(snap.idx) {
+		ids[id] = true
+	}
+	return ids
+}
+
+// update returns snap with dead removed and added merged in. Removing an id
+// needs the trigrams it was added under, deadTrigrams, only for the table.
+func (snap *snapshot) update(dead map[uint32]bool, deadTrigrams map[string]bool, added map[string][]uint32) *snapshot {
+	newDead := make(map[uint32]bool, len(snap.dead)+len(dead))
+	for id := range snap.dead {
+		newDead[id] = true
+	}
+	for id := range dead {
+		newDead[id] = true
+	}
+	idx := snap.idx
+	if idx == nil {
+		idx = make(map[string]PostingList)
+	}
+	return &snapshot{
+		segs:      snap.segs,
+		idx:       UpdatePostings(idx, dead, deadTrigrams, added),
+		dead:      newDead,
+		stringids: snap.stringids,
+		meta:      snap.meta,
+		visits:    snap.visits,
+	}
+}
+
+// clean reports whether snap has nothing that is not stored in a segment.
+func (snap *snapshot) clean() bool {
+	return len(snap.idx) == 0 && len(snap.dead) == 0
+}
+
+// encodeTable returns the table of snap as a segment file.
+func (snap *snapshot) encodeTable() ([]byte, error) {
+	dead := make([]uint32, 0, len(snap.dead))
+	for id := range snap.dead {
+		dead = append(dead, id)
+	}
+	sort.Sort(UInt32ByValue(dead))
+	return encodeIndexFile(snap.idx, dead)
+}
+
+// compaction returns the index of the oldest segment the newest segments
+// should be merged down to, -1 if they are fine as they are.
+func compaction(sizes []int) int {
+	if len(sizes) < 2 {
+		return -1
+	}
+	from := len(sizes) - 1
+	total := sizes[from]
+	for from > 0 && sizes[from-1] <= compactRatio*total {
+		from--
+		total += sizes[from]
+	}
+	if len(sizes)-from < 2 {
+		from = -1
+	}
+	if len(sizes) > maxSegments && (from < 0 || from > maxSegments-1) {
+		from = maxSegments - 1
+	}
+	return from
+}
+
+// mergeSegments returns segs, consecutive and oldest first, merged into a
+// single segment file. If bottom is set nothing is below segs and their dead
+// ids are dropped. It fails if one of segs is corrupt, rather than leave out
+// what the merged segment would lack.
+func mergeSegments(segs []*Segment, bottom bool) ([]byte, error) {
+	sub := &snapshot{segs: segs}
+	idx := make(map[string]PostingList)
+	for _, trigram := range sub.trigrams() {
+		paths := make([]uint32, 0)
+		sub.forEach(trigram, func(id uint32) {
+			paths = append(paths, id)
+		})
+		if len(paths) > 0 {
+			idx[trigram] = EncodePostings(paths)
+		}
+	}
+	if sub.corrupt() {
+		return nil, errIndexChecksum
+	}
+	dead := make([]uint32, 0)
+	if !bottom {
+		for _, seg := range segs {
+			for id := range seg.dead {
+				dead = append(dead, id)
+			}
+		}
+		sort.Sort(UInt32ByValue(dead))
+		dead = dedupIds(dead)
+	}
+	return encodeIndexFile(idx, dead)
+}
+
+func dedupIds(ids []uint32) []uint32 {
+	ret := ids[:0]
+	for i, id := range ids {
+		if i == 0 || id != ids[i-1] {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+func encodeManifest(names []string, generation uint64, stringidsSize int64) []byte {
+	body := strings.Join(names, "\n")
+	bs := make([]byte, manifestHeaderSize, manifestHeaderSize+len(body))
+	copy(bs, manifestMagic)
+	binary.LittleEndian.PutUint32(bs[4:8], manifestVersion)
+	binary.LittleEndian.PutUint64(bs[12:20], generation)
+	binary.LittleEndian.PutUint64(bs[20:28], uint64(stringidsSize))
+	bs = append(bs, body...)
+	binary.LittleEndian.PutUint32(bs[8:12], crc32.Checksum(bs[12:], castagnoli))
+	return bs
+}
+
+func decodeManifest(bs []byte) (names []string, generation uint64, stringidsSize int64, err error) {
+	if len(bs) < manifestHeaderSize || string(bs[:4]) != manifestMagic {
+		return nil, 0, 0, errManifest
+	}
+	if version := binary.LittleEndian.Uint32(bs[4:8]); version != manifestVersion {
+		return nil, 0, 0, fmt.Errorf("unsupported manifest version %d", version)
+	}
+	if crc32.Checksum(bs[12:], castagnoli) != binary.LittleEndian.Uint32(bs[8:12]) {
+		return nil, 0, 0, errIndexChecksum
+	}
+	generation = binary.LittleEndian.Uint64(bs[12:20])
+	stringidsSize = int64(binary.LittleEndian.Uint64(bs[20:28]))
+	body := bs[manifestHeaderSize:]
+	if len(body) == 0 {
+		return []string{}, generation, stringidsSize, nil
+	}
+	names = strings.Split(string(body), "\n")
+	for _, name := range names {
+		if name == "" || filepath.Base(name) != name {
+			return nil, 0, 0, errManifest
+		}
+	}
+	return names, generation, stringidsSize, nil
+}
+
+// segmentName returns the name of the seq'th segment file of the index at
+// path, they sort in the order they were written.
+func segmentName(path string, seq uint64) string {
+	return fmt.Sprintf("%s.seg%08d", filepath.Base(path), seq)
+}
+
+// segmentSeq returns the sequence number in a name made by segmentName.
+func segmentSeq(path, name string) (uint64, bool) {
+	var seq uint64
+	prefix := filepath.Base(path) + ".seg"
+	if !strings.HasPrefix(name, prefix) {
+		return 0, false
+	}
+	_, err := fmt.Sscanf(strings.TrimPrefix(name, prefix), "%d", &seq)
+	return seq, err == nil
+}
+
+// openSegments opens the segments listed in the manifest at path. stringids
+// must be of the generation the manifest records and at least the size.
+func openSegments(path string, generation uint64, stringidsSize int64) ([]*Segment, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	names, gen, size, err := decodeManifest(bs)
+	if err != nil {
+		return nil, err
+	}
+	if gen != generation {
+		return nil, errors.New("index refers to another generation of stringids")
+	}
+	if stringidsSize < size {
+		return nil, fmt.Errorf("index refers to %d bytes of stringids but there are %d", size, stringidsSize)
+	}
+	segs := make([]*Segment, 0, len(names))
+	for _, name := range names {
+		seg, err := OpenSegment(filepath.Join(filepath.Dir(path), name))
+		if err != nil {
+			closeSegments(segs)
+			return nil, fmt.Errorf("segment %s: %v", name, err)
+		}
+		segs = append(segs, seg)
+	}
+	return segs, nil
+}
+
+// removeStaleSegments deletes the segment files of the index at path that are
+// not in segs, left behind by a crash or a failed merge.
+func removeStaleSegments(path string, segs []*Segment) {
+	live := make(map[string]bool)
+	for _, seg := range segs {
+		live[seg.name] = true
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		// temporary files of ds.WriteFileAtomic have the same prefix
+		if strings.HasPrefix(entry.Name(), filepath.Base(path)+".seg") && !live[entry.Name()] {
+			os.Remove(filepath.Join(filepath.Dir(path), entry.Name()))
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testSegment(t *testing.T, idx map[string][]uint32, dead []uint32) *Segment {
+	bs, err := encodeIndexFile(EncodeIndex(idx), dead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, err := decodeIndexFile(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seg
+}
+
+func collect(snap *snapshot, trigram string) []uint32 {
+	ids := make([]uint32, 0)
+	snap.forEach(trigram, func(id uint32) {
+		ids = append(ids, id)
+	})
+	return ids
+}
+
+func TestSnapshotStack(t *testing.T) {
+	bottom := testSegment(t, map[string][]uint32{"abc": {1, 2, 3}, "bcd": {2}}, nil)
+	// 4 was added twice, 2 is deleted from bottom
+	middle := testSegment(t, map[string][]uint32{"abc": {4}, "cde": {4}}, []uint32{2})
+	snap := &snapshot{segs: []*Segment{bottom, middle}}
+	snap = snap.update(map[uint32]bool{3: true}, map[string]bool{"abc": true},
+		map[string][]uint32{"abc": {4, 5}})
+
+	if got := collect(snap, "abc"); !compareSlices(got, []uint32{1, 4, 5}) {
+		t.Errorf("expected [1 4 5] but got %v", got)
+	}
+	if got := collect(snap, "bcd"); len(got) != 0 {
+		t.Errorf("expected bcd to be empty but got %v", got)
+	}
+	all := snap.all()
+	if len(all) != 2 || !compareSlices(all["cde"], []uint32{4}) {
+		t.Errorf("unexpected index %v", all)
+	}
+	ids := snap.ids()
+	if len(ids) != 3 || !ids[1] || !ids[4] || !ids[5] {
+		t.Errorf("unexpected ids %v", ids)
+	}
+}
+
+func TestMergeSegments(t *testing.T) {
+	bottom := testSegment(t, map[string][]uint32{"abc": {1, 2}}, nil)
+	middle := testSegment(t, map[string][]uint32{"abc": {3}}, []uint32{1})
+	top := testSegment(t, map[string][]uint32{"bcd": {3}}, []uint32{2, 7})
+
+	bs, err := mergeSegments([]*Segment{middle, top}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := decodeIndexFile(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// what is below the merged segments must stay hidden
+	if !merged.Dead(1) || !merged.Dead(2) || !merged.Dead(7) {
+		t.Errorf("unexpected dead ids %v", merged.dead)
+	}
+	snap := &snapshot{segs: []*Segment{bottom, merged}}
+	if got := collect(snap, "abc"); !compareSlices(got, []uint32{3}) {
+		t.Errorf("expected [3] but got %v", got)
+	}
+
+	bs, err = mergeSegments([]*Segment{bottom, middle, top}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged, err = decodeIndexFile(bs); err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.dead) != 0 {
+		t.Errorf("expected the bottom segment to have no dead ids but got %v", merged.dead)
+	}
+	if got := merged.Postings("abc").Decode(); !compareSlices(got, []uint32{3}) {
+		t.Errorf("expected [3] but got %v", got)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	cases := []struct {
+		sizes    []int
+		expected int
+	}{
+		{[]int{}, -1},
+		{[]int{100}, -1},
+		{[]int{100, 1}, -1},
+		{[]int{100, 1, 1}, 1},
+		{[]int{4, 2, 1, 1}, 0},
+		{[]int{100, 30, 1}, -1},
+		{[]int{1000, 500, 250, 120, 60, 30, 15, 8, 4, 2}, 0},
+		{[]int{1 << 20, 1 << 18, 1 << 16, 1 << 14, 1 << 12, 1 << 10, 1 << 8, 1 << 6, 1 << 4}, maxSegments - 1},
+	}
+	for _, c := range cases {
+		if got := compaction(c.sizes); got != c.expected {
+			t.Errorf("%v: expected %d but got %d", c.sizes, c.expected, got)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	for _, names := range [][]string{{}, {"index.seg00000001"}, {"index.seg00000001", "index.seg00000003"}} {
+		decoded, gen, size, err := decodeManifest(encodeManifest(names, 42, 1234))
+		if err != nil || len(decoded) != len(names) || gen != 42 || size != 1234 {
+			t.Errorf("expected %v but got %v, %d, %d, %v", names, decoded, gen, size, err)
+		}
+	}
+	bs := encodeManifest([]string{"index.seg00000001"}, 0, 0)
+	bs[len(bs)-1] = '2'
+	if _, _, _, err := decodeManifest(bs); err == nil {
+		t.Error("expected a checksum error")
+	}
+	if _, _, _, err := decodeManifest(encodeManifest([]string{"../elsewhere"}, 0, 0)); err == nil {
+		t.Error("expected a manifest pointing outside its directory to be rejected")
+	}
+	if seq, ok := segmentSeq("/x/index", segmentName("/x/index", 42)); !ok || seq != 42 {
+		t.Errorf("expected 42 but got %d", seq)
+	}
+}
+
+func TestStoreAndCompactSegments(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	touch(t, filepath.Join(root, "segment0.go"))
+	s := testServer(t, root)
+
+	for i := 1; i <= 2*maxSegments; i++ {
+		file := filepath.Join(root, fmt.Sprintf("segment%d.go", i))
+		touch(t, file)
+		s.ApplyChanges([]string{file}, nil, nil)
+		s.writeMu.Lock()
+		if err := s.StoreIndex(); err != nil {
+			t.Fatal(err)
+		}
+		s.writeMu.Unlock()
+		for {
+			merged, err := s.compact()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !merged {
+				break
+			}
+		}
+	}
+	if n := len(s.current().segs); n > maxSegments {
+		t.Errorf("expected at most %d segments but got %d", maxSegments, n)
+	}
+	s.ApplyChanges(nil, []string{filepath.Join(root, "segment3.go")}, nil)
+	s.Close()
+
+	restarted := &Server{}
+	restarted.Init(s.config)
+	defer restarted.Close()
+	matches := candidatePaths(restarted.findCandidates("segment", restarted.current(), nil))
+	if len(matches) != 2*maxSegments {
+		t.Errorf("expected %d matches but got %d", 2*maxSegments, len(matches))
+	}
+	if contains(matches, filepath.Join(root, "segment3.go")) {
+		t.Error("found a path removed before restarting")
+	}
+	segs := restarted.current().segs
+	entries, _ := filepath.Glob(filepath.Join(filepath.Dir(s.config.IndexPath), "index.seg*"))
+	if len(entries) != len(segs) {
+		t.Errorf("expected %d segment files but got %v", len(segs), entries)
+	}
+}
+
+func TestCompactStringids(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	for i := 0; i < 20; i++ {
+		touch(t, filepath.Join(root, fmt.Sprintf("compacted%d.go", i)))
+	}
+	s := testServer(t, root)
+	removed := make([]string, 0)
+	for i := 0; i < 20; i += 2 {
+		removed = append(removed, filepath.Join(root, fmt.Sprintf("compacted%d.go", i)))
+	}
+	s.ApplyChanges(nil, removed, nil)
+	before, dead := s.stringids.Size()
+	if dead == 0 {
+		t.Fatal("expected deleted paths to take up space")
+	}
+
+	// a query still running with the old ids and paths
+	held := s.acquire()
+	heldId, err := held.stringids.GetId(filepath.Join(root, "compacted1.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CompactStringids(); err != nil {
+		t.Fatal(err)
+	}
+	if path, err := held.stringids.StrAt(heldId); err != nil || path != filepath.Join(root, "compacted1.go") {
+		t.Errorf("expected the replaced stringids to stay open while used but got %s, %v", path, err)
+	}
+	if got := collect(held, "com"); len(got) != 10 || held.segs[0].unmap == nil {
+		t.Errorf("expected the replaced segment to stay mapped while used but got %v", got)
+	}
+	held.release()
+	if _, err := held.stringids.StrAt(heldId); err == nil {
+		t.Error("expected the replaced stringids to be closed once released")
+	}
+	if held.segs[0].unmap != nil {
+		t.Error("expected the replaced segment to be unmapped once released")
+	}
+	after, dead := s.stringids.Size()
+	if after >= before || dead != 0 {
+		t.Errorf("expected stringids to shrink from %d but got %d with %d dead", before, after, dead)
+	}
+	check := func(s *Server) {
+		matches := candidatePaths(s.findCandidates("compacted", s.current(), nil))
+		if len(matches) != 10 {
+			t.Errorf("expected 10 matches but got %v", matches)
+		}
+		for _, path := range removed {
+			if contains(matches, path) {
+				t.Errorf("found %s after it was removed", path)
+			}
+		}
+		if !contains(matches, filepath.Join(root, "compacted1.go")) {
+			t.Errorf("compacted1.go not found in %v", matches)
+		}
+		// the metadata moved to the new ids
+		if files := s.findCandidates("compacted", s.current(), &Filter{Modes: ModeFile}); len(files) != 10 {
+			t.Errorf("expected 10 files but got %d", len(files))
+		}
+	}
+	check(s)
+	s.Close()
+
+	restarted := &Server{}
+	restarted.Init(s.config)
+	defer restarted.Close()
+	check(restarted)
+}
+
+func TestCorruptSegmentRebuilt(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "root", "abcdef.go")
+	touch(t, file)
+	s := testServer(t, filepath.Join(dir, "root"))
+	seg := filepath.Join(filepath.Dir(s.config.IndexPath), s.current().segs[0].name)
+	s.Close()
+	bs, err := os.ReadFile(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first posting list, of ".go"
+	count := int(binary.LittleEndian.Uint32(bs[8:12]))
+	keysLen := int(binary.LittleEndian.Uint64(bs[16:24]))
+	bs[indexHeaderSize+count*segmentEntrySize+keysLen] ^= 1
+	if err := os.WriteFile(seg, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := &Server{}
+	restarted.Init(s.config)
+	defer restarted.Close()
+	if !contains(restarted.FindMatches("abcdef.go"), file) {
+		t.Errorf("%s not found from the intact posting lists", file)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for restarted.corrupt() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the index to be rebuilt")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err := os.Stat(seg); !os.IsNotExist(err) {
+		t.Errorf("expected the corrupt segment to be removed but got %v", err)
+	}
+	if got := collect(restarted.current(), ".go"); len(got) != 1 {
+		t.Errorf("expected the rebuilt index to have .go but got %v", got)
+	}
+}
+
+func TestIndexNewerThanStringids(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "root", "truncated.go")
+	touch(t, file)
+	s := testServer(t, filepath.Join(dir, "root"))
+	s.Close()
+	// as if stringids had been compacted but not the index
+	if err := os.Truncate(s.config.StringidsPath, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := &Server{}
+	restarted.Init(s.config)
+	defer restarted.Close()
+	if !contains(restarted.FindMatches("truncated"), file) {
+		t.Errorf("%s not found after restarting with truncated stringids", file)
+	}
+}
@@ -1,127 +1,935 @@
 package lib
 
 import (
-	"bytes"
-	"encoding/gob"
+	"bufio"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pankajroark/pathsearch/ds"
 )
 
-const IndexPath = "/Users/pankajg/.pathsearchindex"
-const StringidsPath = "/Users/pankajg/.pathstringids"
+/*
+ Concurrency: queries never take a lock. They hold on to the current
+ snapshot, an index that is never mutated once published, until they are
+ done, see acquire. Anything that changes the index builds a new snapshot
+ from the current one and swaps it in atomically; writers are serialized by
+ writeMu and concurrent Index calls are coalesced into a single walk. The
+ compactor merges segments without holding writeMu and only takes it to swap
+ the merged segment in.
+*/
 
 type Server struct {
-	idx       map[string][]uint32
-	roots     []string
-	stringids *Stringids
+	snap       atomic.Pointer[snapshot]
+	writeMu    sync.Mutex
+	indexer    coalescer
+	rootsMu    sync.Mutex
+	roots      []string
+	stringids  *Stringids
+	meta       *MetaStore
+	visits     *VisitStore
+	syncPolicy SyncPolicy
+	config     *Config
+	watcher    *Watcher
+	// guarded by writeMu
+	dirs *DirTree
+	// cancelled by Close to interrupt scans in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+	// set when the index changed since it was last stored, guarded by writeMu
+	dirty bool
+	// sequence number of the next segment file
+	segSeq atomic.Uint64
+	// signals the compactor that segments were added
+	compactions chan struct{}
+	// held while segments are merged or stringids compacted
+	compactMu  sync.Mutex
+	background sync.WaitGroup
+	closeOnce  sync.Once
 }
 
 func (s *Server) Roots() []string {
-	return s.roots
+	s.rootsMu.Lock()
+	defer s.rootsMu.Unlock()
+	return append([]string(nil), s.roots...)
+}
+
+// current returns the published snapshot, to be used with writeMu held.
+// Readers that do not hold it use acquire.
+func (s *Server) current() *snapshot {
+	return s.snap.Load()
+}
+
+// StoreIndex writes the changes made since it was last called out as a new
+// segment. It must be called with writeMu held, the index stays dirty if it
+// could not be stored.
+func (s *Server) StoreIndex() error {
+	snap := s.current()
+	if snap.clean() {
+		s.dirty = false
+		return nil
+	}
+	bs, err := snap.encodeTable()
+	if err != nil {
+		return err
+	}
+	seg, err := s.writeSegment(bs)
+	if err != nil {
+		return err
+	}
+	segs := append(snap.segs[:len(snap.segs):len(snap.segs)], seg)
+	if err := s.storeManifest(segs); err != nil {
+		seg.Close()
+		os.Remove(filepath.Join(filepath.Dir(s.config.IndexPath), seg.name))
+		return err
+	}
+	s.publish(&snapshot{segs: segs, stringids: snap.stringids, meta: snap.meta, visits: snap.visits})
+	s.dirty = false
+	s.wakeCompactor()
+	return nil
 }
 
-func (s *Server) StoreIndex() {
-	b := new(bytes.Buffer)
-	e := gob.NewEncoder(b)
-	err := e.Encode(s.idx)
+// wakeCompactor has the compactor look at the index, unless it is about to
+// already.
+func (s *Server) wakeCompactor() {
+	select {
+	case s.compactions <- struct{}{}:
+	default:
+	}
+}
+
+// writeSegment stores bs as a new segment file and opens it.
+func (s *Server) writeSegment(bs []byte) (*Segment, error) {
+	seq := s.segSeq.Add(1) - 1
+	path := filepath.Join(filepath.Dir(s.config.IndexPath), segmentName(s.config.IndexPath, seq))
+	if err := ds.WriteFileAtomic(path, bs, 0644); err != nil {
+		return nil, err
+	}
+	seg, err := OpenSegment(path)
 	if err != nil {
-		log.Fatal("failed to encode index")
+		os.Remove(path)
+		return nil, err
 	}
-	ioutil.WriteFile(IndexPath, b.Bytes(), 0644)
+	return seg, nil
 }
 
+func (s *Server) storeManifest(segs []*Segment) error {
+	names := make([]string, 0, len(segs))
+	for _, seg := range segs {
+		names = append(names, seg.name)
+	}
+	size, _ := s.stringids.Size()
+	return ds.WriteFileAtomic(s.config.IndexPath, encodeManifest(names, s.stringids.Generation(), size), 0644)
+}
+
+// storeIndex is StoreIndex for callers with nobody to report to, it stores
+// the directory tree and what is kept about the files by id as well. The tree
+// is only stored along with the index it lists the files of, a tree ahead of
+// the index would keep the next scan from reporting files the index lacks.
+func (s *Server) storeIndex() {
+	if err := s.StoreIndex(); err != nil {
+		log.Printf("failed to store index: %v", err)
+	} else if err := s.dirs.Store(); err != nil {
+		log.Printf("failed to store directory tree: %v", err)
+	}
+	s.storeTables()
+}
+
+// storeTables stores the metadata and the visits of the files if they
+// changed since they were last stored.
+func (s *Server) storeTables() {
+	if err := s.meta.Store(); err != nil {
+		log.Printf("failed to store file metadata: %v", err)
+	}
+	if err := s.visits.Store(); err != nil {
+		log.Printf("failed to store visits: %v", err)
+	}
+}
+
+// ReadIndex maps the stored segments. An index that is missing, corrupt or in
+// another format is an error, the caller has to index from scratch.
 func (s *Server) ReadIndex() error {
 	fmt.Println("Reading Index...")
-	_, cerr := os.Stat(IndexPath)
-	if cerr != nil {
-		fmt.Println("Index does not exist.")
-		return cerr
-	}
-	var decodedIdx map[string][]uint32
-	bs, err := ioutil.ReadFile(IndexPath)
+	size, _ := s.stringids.Size()
+	segs, err := openSegments(s.config.IndexPath, s.stringids.Generation(), size)
 	if err != nil {
-		log.Fatal("failed to decode index")
+		if os.IsNotExist(err) {
+			fmt.Println("Index does not exist.")
+		} else {
+			fmt.Printf("Index is unusable, rebuilding: %v\n", err)
+		}
+		removeStaleSegments(s.config.IndexPath, nil)
 		return err
 	}
-	d := gob.NewDecoder(bytes.NewBuffer(bs))
-	d.Decode(&decodedIdx)
-	s.idx = decodedIdx
+	removeStaleSegments(s.config.IndexPath, segs)
+	for _, seg := range segs {
+		if seq, ok := segmentSeq(s.config.IndexPath, seg.name); ok && seq >= s.segSeq.Load() {
+			s.segSeq.Store(seq + 1)
+		}
+	}
+	s.publish(&snapshot{segs: segs, stringids: s.stringids, meta: s.meta, visits: s.visits})
 	return nil
 }
 
-func (s *Server) Init() {
+func (s *Server) Init(config *Config) {
+	s.config = config
 	s.roots = make([]string, 0)
-	s.roots = append(s.roots, "/Users/pankajg/workspace/source/science")
-	s.roots = append(s.roots, "/Users/pankajg/workspace/source/birdcage")
-	s.stringids = NewStringids(StringidsPath)
-	err := s.ReadIndex()
-	if err != nil {
+	// Roots added or removed at runtime win over the ones in the config
+	// file, but not over the ones given on the command line.
+	roots, err := ReadRoots(config.RootsPath())
+	if err != nil || config.RootsOverride {
+		roots = config.Roots
+	}
+	s.roots = append(s.roots, roots...)
+	for _, path := range []string{config.IndexPath, config.StringidsPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			log.Fatalf("failed to create %s: %v", filepath.Dir(path), err)
+		}
+	}
+	if s.syncPolicy, err = ParseSyncPolicy(config.Fsync); err != nil {
+		log.Printf("%v, syncing at intervals", err)
+	}
+	s.stringids = NewStringids(config.StringidsPath, s.syncPolicy)
+	var metaLoaded bool
+	s.meta, metaLoaded = OpenMetaStore(config.MetaPath(), s.stringids.Generation())
+	s.visits = OpenVisitStore(config.VisitsPath(), s.stringids.Generation())
+	s.publish(&snapshot{stringids: s.stringids, meta: s.meta, visits: s.visits})
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.compactions = make(chan struct{}, 1)
+	s.dirs = LoadDirTree(config.DirTreePath(), config.Exclude)
+	if config.WalkWorkers > 0 {
+		s.dirs.Workers = config.WalkWorkers
+	}
+	err = s.ReadIndex()
+	if err == nil {
+		s.writeMu.Lock()
+		s.dropDeleted()
+		s.writeMu.Unlock()
+	}
+	s.background.Add(1)
+	go s.compactor()
+	if err != nil || !metaLoaded {
+		// the tree says what the lost index had seen, start over. Lost
+		// metadata needs every file stat'ed again just as well.
+		s.dirs.Clear()
 		s.Index()
 	}
 }
 
+// Close interrupts a scan in progress, stops watching and compacting, stores
+// the index and checkpoints stringids. Calls after the first do nothing.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		s.rootsMu.Lock()
+		w := s.watcher
+		s.rootsMu.Unlock()
+		if w != nil {
+			w.Close()
+		}
+		s.background.Wait()
+		s.writeMu.Lock()
+		defer s.writeMu.Unlock()
+		s.storeIndex()
+		if err := s.stringids.Checkpoint(); err != nil {
+			log.Printf("failed to checkpoint stringids: %v", err)
+		}
+		// the segments are closed once queries in flight are done with
+		// them, later ones find nothing
+		s.publish(&snapshot{stringids: s.stringids, meta: s.meta, visits: s.visits})
+		s.stringids.Close()
+	})
+}
+
+// compactor merges segments in the background whenever they were added to,
+// until Close. A corrupt index is indexed again from scratch first.
+func (s *Server) compactor() {
+	defer s.background.Done()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.compactions:
+		}
+		if s.corrupt() {
+			// storing the new index wakes us up again
+			s.Index()
+			continue
+		}
+		for s.ctx.Err() == nil {
+			merged, err := s.compact()
+			if err != nil {
+				log.Printf("failed to compact the index: %v", err)
+			}
+			if !merged || err != nil {
+				break
+			}
+		}
+		if size, dead := s.current().stringids.Size(); size >= stringidsCompactMin && dead > size/2 && s.ctx.Err() == nil {
+			if err := s.CompactStringids(); err != nil {
+				log.Printf("failed to compact stringids: %v", err)
+			}
+		}
+	}
+}
+
+// corrupt reports whether the published index lacks ids because a posting
+// list did not match its checksum.
+func (s *Server) corrupt() bool {
+	snap := s.acquire()
+	defer snap.release()
+	return snap.corrupt()
+}
+
+// CompactStringids drops the deleted paths from stringids, which renumbers the
+// live ones, and renumbers the index to match. Both are swapped in at once,
+// queries see either the old ids and paths or the new ones.
+//
+// The compacted wal only replaces the old one once the index for it is
+// written, and the manifest pointing at that index after. Should the process
+// die in between, the manifest records a larger wal than there is and the
+// index is rebuilt on the next start.
+func (s *Server) CompactStringids() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	snap := s.current()
+	tmp := s.config.StringidsPath + ".compact"
+	remap, err := s.stringids.CompactTo(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	all := snap.all()
+	if snap.corrupt() {
+		os.Remove(tmp)
+		return errIndexChecksum
+	}
+	bs, err := encodeIndexFile(EncodeIndex(RemapIds(all, remap)), nil)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	seg, err := s.writeSegment(bs)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	dir := filepath.Dir(s.config.IndexPath)
+	if err := os.Rename(tmp, s.config.StringidsPath); err != nil {
+		os.Remove(tmp)
+		seg.Close()
+		os.Remove(filepath.Join(dir, seg.name))
+		return err
+	}
+	old := s.stringids
+	oldSize, _ := old.Size()
+	// the old wal stays open for queries still using it, until the last
+	// snapshot referring to it is released
+	old.release()
+	s.stringids = NewStringids(s.config.StringidsPath, s.syncPolicy)
+	s.meta = s.meta.Remapped(remap, s.stringids.Generation())
+	s.visits = s.visits.Remapped(remap, s.stringids.Generation())
+	if err := s.storeManifest([]*Segment{seg}); err != nil {
+		// the index on disk is unusable now, the next start rebuilds it
+		log.Printf("failed to store index manifest: %v", err)
+	}
+	// tables that are not stored are dropped with the next start, lost
+	// metadata has every file stat'ed again
+	s.storeTables()
+	s.publish(&snapshot{segs: []*Segment{seg}, stringids: s.stringids, meta: s.meta, visits: s.visits})
+	s.dirty = false
+	for _, old := range snap.segs {
+		os.Remove(filepath.Join(dir, old.name))
+	}
+	newSize, _ := s.stringids.Size()
+	fmt.Printf("Compacted stringids from %d to %d bytes\n", oldSize, newSize)
+	return nil
+}
+
+// compact merges the segments picked by compaction into one and reports
+// whether there was anything to merge. Merging runs without holding writeMu,
+// the index can change meanwhile but only ever gets segments added on top.
+func (s *Server) compact() (bool, error) {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	snap := s.acquire()
+	defer snap.release()
+	sizes := make([]int, 0, len(snap.segs))
+	for _, seg := range snap.segs {
+		sizes = append(sizes, seg.size)
+	}
+	from := compaction(sizes)
+	if from < 0 {
+		return false, nil
+	}
+	merging := snap.segs[from:]
+	bs, err := mergeSegments(merging, from == 0)
+	if err != nil {
+		return false, err
+	}
+	seg, err := s.writeSegment(bs)
+	if err != nil {
+		return false, err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	dir := filepath.Dir(s.config.IndexPath)
+	cur := s.current()
+	for i, old := range merging {
+		if from+i >= len(cur.segs) || cur.segs[from+i] != old {
+			seg.Close()
+			os.Remove(filepath.Join(dir, seg.name))
+			return false, fmt.Errorf("segments changed while merging")
+		}
+	}
+	segs := append(append(cur.segs[:from:from], seg), cur.segs[from+len(merging):]...)
+	if err := s.storeManifest(segs); err != nil {
+		seg.Close()
+		os.Remove(filepath.Join(dir, seg.name))
+		return false, err
+	}
+	s.publish(&snapshot{segs: segs, idx: cur.idx, dead: cur.dead, stringids: cur.stringids, meta: cur.meta, visits: cur.visits})
+	// the merged segments stay mapped until queries in flight are done
+	for _, old := range merging {
+		os.Remove(filepath.Join(dir, old.name))
+	}
+	fmt.Printf("Merged %d segments into %s\n", len(merging), seg.name)
+	return true, nil
+}
+
+// Watch keeps the index up to date from filesystem events. It fails if events
+// are not available, the caller should then fall back to reindexing
+// periodically. Once the watches are in place it walks everything once more to
+// catch up with changes made before, so it takes as long as an Index.
+func (s *Server) Watch() error {
+	w, err := NewWatcher(s)
+	if err != nil {
+		return err
+	}
+	for _, root := range s.Roots() {
+		if _, err := w.AddRoot(root, s.dirs.RootIgnorer(root)); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	s.rootsMu.Lock()
+	s.watcher = w
+	s.rootsMu.Unlock()
+	go w.Run()
+	s.Index()
+	return nil
+}
+
+// Index walks all roots and publishes the result. Calls that overlap with a
+// walk in progress share the next walk instead of starting their own.
 func (s *Server) Index() {
-	fmt.Printf("indexing %s\n", s.roots[0])
-	s.idx = MergeIndices(s.idx, s.index(s.roots[0]))
-	for i := 1; i < len(s.roots); i++ {
-		fmt.Printf("indexing %s\n", s.roots[i])
-		newIdx := s.index(s.roots[i])
-		s.idx = MergeIndices(s.idx, newIdx)
+	s.indexer.Do(s.reindex)
+}
+
+func (s *Server) reindex() {
+	// Holding writeMu across the walk keeps a root removed meanwhile from
+	// being merged back in.
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	old := s.current()
+	discard := old.corrupt()
+	if discard {
+		fmt.Println("Index is corrupt, indexing from scratch")
+		s.dirs.Clear()
+	}
+	roots := s.Roots()
+	generation := s.meta.NextGeneration()
+	added := make([]string, 0)
+	removed := make([]string, 0)
+	stats := make(map[string]map[string]FileMeta)
+	rebuild := false
+	for _, root := range roots {
+		fmt.Printf("indexing %s\n", root)
+		a, r, known, err := s.scan(root)
+		if err != nil {
+			fmt.Printf("indexing %s interrupted: %v\n", root, err)
+			return
+		}
+		added = append(added, a...)
+		removed = append(removed, r...)
+		stats[root] = s.dirs.TakeStats()
+		rebuild = rebuild || !known
+	}
+	if rebuild || discard {
+		s.rebuild(roots, discard)
+	} else {
+		fmt.Printf("%d paths added, %d removed\n", len(added), len(removed))
+		s.applyChanges(added, removed)
+	}
+	if changed := s.recordStats(stats, generation); changed > 0 {
+		fmt.Printf("%d files changed\n", changed)
+	}
+	fmt.Printf("Index has %d segments\n", len(s.current().segs))
+	s.storeIndex()
+	if discard && !s.dirty {
+		for _, seg := range old.segs {
+			os.Remove(filepath.Join(filepath.Dir(s.config.IndexPath), seg.name))
+		}
 	}
-	fmt.Printf("Total number of trigrams: %d", len(s.idx))
-	s.StoreIndex()
 }
 
-func (s *Server) index(path string) map[string][]uint32 {
-	fmt.Printf("scanning %s\n", path)
-	idx := make(map[string][]uint32)
-	index_path := func(path string) {
-		pathId := s.stringids.Add(path)
-		base := filepath.Base(path)
-		for i := 0; i < len(base)-2; i++ {
-			trigram := strings.ToLower(base[i : i+3])
-			idx[trigram] = append(idx[trigram], pathId)
+// recordStats puts the metadata the walk found under each root into the
+// store and returns how many files changed size or mtime since they were
+// last stat'ed. A file under nested roots belongs to the innermost one. It
+// must be called with writeMu held.
+func (s *Server) recordStats(stats map[string]map[string]FileMeta, generation uint32) int {
+	roots := make([]string, 0, len(stats))
+	for root := range stats {
+		roots = append(roots, root)
+	}
+	sort.Slice(roots, func(i, j int) bool { return len(roots[i]) < len(roots[j]) })
+	changed := 0
+	for _, root := range roots {
+		for path, meta := range stats[root] {
+			pathId, err := s.stringids.GetId(path)
+			if err != nil {
+				continue
+			}
+			meta.Root, meta.Generation = RootId(root), generation
+			if s.meta.Put(pathId, meta) {
+				changed++
+			}
 		}
 	}
+	return changed
+}
+
+// forgetFile drops the metadata and the visits of pathId. It must be called
+// with writeMu held.
+func (s *Server) forgetFile(pathId uint32) {
+	s.meta.Delete(pathId)
+	s.visits.Delete(pathId)
+}
+
+// rootOf returns the innermost root path is under.
+func (s *Server) rootOf(path string) (string, bool) {
+	found := ""
+	for _, root := range s.Roots() {
+		if underRoot(path, root) && len(root) > len(found) {
+			found = root
+		}
+	}
+	return found, found != ""
+}
+
+// scan returns what changed under root since the last scan, from its git index
+// if configured to and root is a repository.
+func (s *Server) scan(root string) (added, removed []string, known bool, err error) {
+	if s.config.Git {
+		added, removed, known, err := s.dirs.ScanGit(s.ctx, root, s.config.GitUntracked)
+		if err == nil || err == s.ctx.Err() {
+			return added, removed, known, err
+		}
+		if err != errNotGitRepo {
+			log.Printf("failed to read the git index of %s, scanning instead: %v", root, err)
+		}
+	}
+	return s.dirs.Scan(s.ctx, root)
+}
+
+// rebuild indexes every file the tree knows about from scratch. It is used
+// when the tree has no record of what went into the index before, the
+// index is compared with all files then to find what vanished. With discard
+// the segments are dropped and every file goes into the table.
+func (s *Server) rebuild(roots []string, discard bool) {
+	old := s.current()
+	indexed := old.ids()
+	base := old
+	if discard {
+		base = &snapshot{stringids: old.stringids, meta: old.meta, visits: old.visits}
+	}
+	seen := make(map[uint32]bool)
+	fresh := make(map[string][]uint32)
+	for _, root := range roots {
+		for _, path := range s.dirs.AllFiles(root) {
+			pathId, err := s.stringids.Add(path)
+			if err != nil {
+				log.Printf("failed to add %s: %v", path, err)
+				continue
+			}
+			seen[pathId] = true
+			if indexed[pathId] && !discard {
+				continue
+			}
+			for _, trigram := range trigrams(path) {
+				fresh[trigram] = append(fresh[trigram], pathId)
+			}
+		}
+	}
+	dead, deadTrigrams := s.vanished(indexed, seen)
+	s.meta.Retain(func(pathId uint32) bool { return seen[pathId] })
+	s.visits.Retain(func(pathId uint32) bool { return seen[pathId] })
+	s.publish(base.update(dead, deadTrigrams, fresh))
+}
 
-	walkFn := func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() && filepath.Ext(path) != ".class" {
-			index_path(path)
+// vanished returns the ids in indexed that the latest walk did not see again
+// and the trigrams of their paths, and marks the paths deleted in stringids.
+func (s *Server) vanished(indexed, seen map[uint32]bool) (map[uint32]bool, map[string]bool) {
+	dead := make(map[uint32]bool)
+	deadTrigrams := make(map[string]bool)
+	for pathId := range indexed {
+		if seen[pathId] {
+			continue
 		}
+		dead[pathId] = true
+		s.forgetFile(pathId)
+		path, err := s.stringids.StrAt(pathId)
+		if err != nil {
+			continue
+		}
+		for _, trigram := range trigrams(path) {
+			deadTrigrams[trigram] = true
+		}
+		if err := s.stringids.Delete(path); err != nil {
+			log.Printf("failed to delete %s: %v", path, err)
+		}
+	}
+	if len(dead) > 0 {
+		fmt.Printf("Dropping %d vanished paths\n", len(dead))
+	}
+	return dead, deadTrigrams
+}
+
+// dropDeleted marks the ids in the index that stringids has deleted dead. A
+// path is deleted from stringids right away but the index only when stored,
+// a crash in between leaves the index with ids a removed path can no longer
+// be looked up by. Every id is looked at, so it only runs once the index is
+// read. It must be called with writeMu held.
+func (s *Server) dropDeleted() {
+	if _, dead := s.stringids.Size(); dead == 0 {
+		return
+	}
+	old := s.current()
+	dead := make(map[uint32]bool)
+	deadTrigrams := make(map[string]bool)
+	for pathId := range old.ids() {
+		if !s.stringids.Deleted(pathId) {
+			continue
+		}
+		dead[pathId] = true
+		s.forgetFile(pathId)
+		if path, err := s.stringids.StrAt(pathId); err == nil {
+			for _, trigram := range trigrams(path) {
+				deadTrigrams[trigram] = true
+			}
+		}
+	}
+	if len(dead) > 0 {
+		fmt.Printf("Dropping %d deleted paths\n", len(dead))
+		s.publish(old.update(dead, deadTrigrams, nil))
+		s.dirty = true
+	}
+}
+
+// ApplyChanges updates the index in place of a full walk. added and removed
+// are files, every file under one of removedDirs is dropped as well. The
+// directory tree is updated to match and the added files are stat'ed for
+// their metadata. The index is not stored, see StoreIndexIfDirty.
+func (s *Server) ApplyChanges(added, removed, removedDirs []string) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	removed = append([]string(nil), removed...)
+	for _, dir := range removedDirs {
+		removed = append(removed, s.dirs.RemoveDir(dir)...)
+	}
+	for _, path := range removed {
+		s.dirs.RemoveFile(path)
+	}
+	s.applyChanges(added, removed)
+	for _, path := range added {
+		if _, err := s.stringids.GetId(path); err == nil {
+			s.dirs.AddFile(path)
+		}
+	}
+	s.statFiles(added)
+	s.dirty = true
+}
+
+// Restat records the metadata of paths anew, as after they were written to
+// or had their mode changed. Paths that are not in the index are skipped.
+func (s *Server) Restat(paths []string) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.statFiles(paths)
+}
+
+// statFiles stats paths and records their metadata with the generation of
+// the latest walk. It must be called with writeMu held.
+func (s *Server) statFiles(paths []string) {
+	stats := make(map[string]map[string]FileMeta)
+	for _, path := range paths {
+		root, found := s.rootOf(path)
+		fi, err := os.Lstat(path)
+		if !found || err != nil {
+			continue
+		}
+		if stats[root] == nil {
+			stats[root] = make(map[string]FileMeta)
+		}
+		stats[root][path] = fileMetaOf(fi)
+	}
+	s.recordStats(stats, s.meta.Generation())
+}
+
+// applyChanges must be called with writeMu held.
+func (s *Server) applyChanges(added, removed []string) {
+	old := s.current()
+	dead := make(map[uint32]bool)
+	deadTrigrams := make(map[string]bool)
+	// a file replaced by renaming another over it, as editors save, is
+	// removed and added at once, it keeps its visits
+	visits := make(map[string]Visits)
+	remove := func(pathId uint32, path string) {
+		dead[pathId] = true
+		if v, found := s.visits.Get(pathId); found {
+			visits[path] = v
+		}
+		s.forgetFile(pathId)
+		for _, trigram := range trigrams(path) {
+			deadTrigrams[trigram] = true
+		}
+		if err := s.stringids.Delete(path); err != nil {
+			log.Printf("failed to delete %s: %v", path, err)
+		}
+	}
+	for _, path := range removed {
+		if pathId, err := s.stringids.GetId(path); err == nil && !dead[pathId] {
+			remove(pathId, path)
+		}
+	}
+
+	fresh := make(map[string][]uint32)
+	for _, path := range added {
+		pathId, err := s.stringids.Add(path)
+		if err != nil {
+			log.Printf("failed to add %s: %v", path, err)
+			continue
+		}
+		if v, found := visits[path]; found {
+			s.visits.Put(pathId, v)
+		}
+		for _, trigram := range trigrams(path) {
+			fresh[trigram] = append(fresh[trigram], pathId)
+		}
+	}
+	s.publish(old.update(dead, deadTrigrams, fresh))
+}
+
+// StoreIndexIfDirty stores the index if ApplyChanges changed it since it was
+// last stored, and the visits recorded since they were last stored.
+func (s *Server) StoreIndexIfDirty() {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.dirty {
+		s.storeIndex()
+	} else {
+		s.storeTables()
+	}
+}
+
+// Visit records that path was opened, files visited often and lately rank
+// higher. It fails if path is not in the index. A visit at the time stringids
+// are compacted may be lost.
+func (s *Server) Visit(path string) error {
+	return s.visitAt(path, time.Now())
+}
+
+// VisitAll is Visit for many paths, it returns the ones not in the index.
+func (s *Server) VisitAll(paths []string) []string {
+	now := time.Now()
+	unknown := make([]string, 0)
+	for _, path := range paths {
+		if err := s.visitAt(path, now); err != nil {
+			unknown = append(unknown, path)
+		}
+	}
+	return unknown
+}
+
+// visitAt does not take writeMu, a visit would otherwise wait for a walk in
+// progress.
+func (s *Server) visitAt(path string, now time.Time) error {
+	snap := s.acquire()
+	defer snap.release()
+	path = filepath.Clean(expandHome(path))
+	pathId, err := snap.stringids.GetId(path)
+	if err != nil {
+		return fmt.Errorf("%s is not indexed", path)
+	}
+	snap.visits.Visit(pathId, now)
+	return nil
+}
+
+// storeRoots must be called with rootsMu held.
+func (s *Server) storeRoots() {
+	err := WriteRoots(s.config.RootsPath(), s.roots)
+	if err != nil {
+		log.Printf("failed to store roots: %v", err)
+	}
+}
+
+// AddRoot validates root, starts tracking it and indexes it.
+func (s *Server) AddRoot(root string) (string, error) {
+	root, err := ValidateRoot(root)
+	if err != nil {
+		return "", err
+	}
+	s.rootsMu.Lock()
+	for _, r := range s.roots {
+		if r == root {
+			s.rootsMu.Unlock()
+			return "", fmt.Errorf("%s is already a root", root)
+		}
+	}
+	s.roots = append(s.roots, root)
+	s.storeRoots()
+	w := s.watcher
+	s.rootsMu.Unlock()
+	if w != nil {
+		if _, err := w.AddRoot(root, s.dirs.RootIgnorer(root)); err != nil {
+			log.Printf("failed to watch %s: %v", root, err)
+		}
+	}
+	s.Index()
+	return root, nil
+}
+
+// RemoveRoot stops tracking root and purges its paths from the index and from
+// stringids.
+func (s *Server) RemoveRoot(root string) error {
+	root, err := absRoot(root)
+	if err != nil {
 		return err
 	}
+	s.rootsMu.Lock()
+	roots := make([]string, 0, len(s.roots))
+	for _, r := range s.roots {
+		if r != root {
+			roots = append(roots, r)
+		}
+	}
+	if len(roots) == len(s.roots) {
+		s.rootsMu.Unlock()
+		return fmt.Errorf("%s is not a root", root)
+	}
+	s.roots = roots
+	s.storeRoots()
+	w := s.watcher
+	s.rootsMu.Unlock()
+	if w != nil && !isUnderAny(root, roots) {
+		w.Remove(root)
+		// roots nested inside the removed one still need their watches
+		for _, r := range roots {
+			if underRoot(r, root) {
+				w.AddRoot(r, s.dirs.RootIgnorer(r))
+			}
+		}
+	}
 
-	filepath.Walk(path, walkFn)
-	return idx
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	snap := s.current()
+	dead := make(map[uint32]bool)
+	deadTrigrams := make(map[string]bool)
+	for pathId := range snap.ids() {
+		path, err := s.stringids.StrAt(pathId)
+		if err != nil || !underRoot(path, root) || isUnderAny(path, roots) {
+			continue
+		}
+		dead[pathId] = true
+		s.forgetFile(pathId)
+		for _, trigram := range trigrams(path) {
+			deadTrigrams[trigram] = true
+		}
+		if err := s.stringids.Delete(path); err != nil {
+			log.Printf("failed to delete %s: %v", path, err)
+		}
+	}
+	s.dirs.Forget(root, roots)
+	fmt.Printf("Removed %d paths under %s\n", len(dead), root)
+	s.publish(snap.update(dead, deadTrigrams, nil))
+	s.storeIndex()
+	return nil
+}
+
+// isUnderAny reports whether path is covered by one of roots, roots may be
+// nested.
+func isUnderAny(path string, roots []string) bool {
+	for _, root := range roots {
+		if underRoot(path, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// trigrams returns the trigrams of the file name part of path.
+func trigrams(path string) []string {
+	base := filepath.Base(path)
+	trigrams := make([]string, 0, len(base))
+	for i := 0; i < len(base)-2; i++ {
+		trigrams = append(trigrams, strings.ToLower(base[i:i+3]))
+	}
+	return trigrams
 }
 
 func (s *Server) FindMatches(word string) []string {
-	candidates := s.findCandidates(word, s.idx)
+	return s.FindMatchesWith(word, nil)
+}
+
+// FindMatchesWith is FindMatches for the files that pass filter, nil passes
+// all of them.
+func (s *Server) FindMatchesWith(word string, filter *Filter) []string {
+	snap := s.acquire()
+	defer snap.release()
+	candidates := s.findCandidates(word, snap, filter)
+	if snap.corrupt() {
+		// the compactor has the index rebuilt
+		s.wakeCompactor()
+	}
 	return match(candidates, word)
 }
 
-func (s *Server) findCandidates(fuzz string, idx map[string][]uint32) []string {
+func (s *Server) findCandidates(fuzz string, snap *snapshot, filter *Filter) []candidate {
 	candsSeen := make(map[uint32]int)
 	for i := 0; i < len(fuzz)-2; i++ {
 		trigram := strings.ToLower(fuzz[i : i+3])
-		pathIds := idx[trigram]
-		for _, pathId := range pathIds {
+		snap.forEach(trigram, func(pathId uint32) {
 			candsSeen[pathId]++
-		}
+		})
 	}
 
-	// at least two trigrams should match
-	cands := make([]string, 0)
+	// at least two trigrams should match. An id can outlive its path in the
+	// index when the process died after deleting the path from stringids but
+	// before storing the index, such ids are skipped.
+	cands := make([]candidate, 0)
+	now := time.Now()
 	for cand, count := range candsSeen {
-		if count > 2 {
-			pathstr, _ := s.stringids.StrAtOffset(cand)
-			cands = append(cands, pathstr)
+		if count <= 2 || snap.stringids.Deleted(cand) {
+			continue
+		}
+		meta, found := snap.meta.Get(cand)
+		if filter != nil && (!found || !filter.Match(meta)) {
+			continue
 		}
+		pathstr, _ := snap.stringids.StrAt(cand)
+		cands = append(cands, candidate{path: pathstr, meta: meta, frecency: snap.visits.Frecency(cand, now)})
 	}
 	return cands
 }
@@ -135,15 +943,55 @@ func score(cand, fuzz string) int {
 func CreateQueryHandler(s *Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		word := r.URL.Query().Get("word")
+		filter, err := ParseFilter(r.URL.Query(), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		//fmt.Println(candidates)
-		for _, result := range s.FindMatches(word) {
+		for _, result := range s.FindMatchesWith(word, filter) {
 			//_ = result
 			fmt.Fprintln(w, string(result))
 		}
 	}
 }
 
+func CreateVisitHandler(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("path")
+		if err := s.Visit(path); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "Visited %s\n", path)
+	}
+}
+
+// CreateVisitBatchHandler records the visits of the paths in the body, one
+// per line, and of the path parameters. The paths that are not indexed are
+// listed back.
+func CreateVisitBatchHandler(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		paths := r.URL.Query()["path"]
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			if path := strings.TrimSpace(scanner.Text()); path != "" {
+				paths = append(paths, path)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		unknown := s.VisitAll(paths)
+		fmt.Fprintf(w, "Visited %d paths\n", len(paths)-len(unknown))
+		for _, path := range unknown {
+			fmt.Fprintf(w, "not indexed: %s\n", path)
+		}
+	}
+}
+
 func CreateIndexHander(s *Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		s.Index()
@@ -153,10 +1001,30 @@ func CreateIndexHander(s *Server) http.HandlerFunc {
 
 func CreateAddRootHandler(s *Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		root := r.URL.Query().Get("root")
-		// todo validate root, path must exist on disk
-		s.roots = append(s.roots, root)
-		s.Index()
+		root, err := s.AddRoot(r.URL.Query().Get("root"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		fmt.Fprintf(w, "Added root %s\n", root)
 	}
 }
+
+func CreateRemoveRootHandler(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		root := r.URL.Query().Get("root")
+		if err := s.RemoveRoot(root); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "Removed root %s\n", root)
+	}
+}
+
+func CreateRootsHandler(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, root := range s.Roots() {
+			fmt.Fprintln(w, root)
+		}
+	}
+}
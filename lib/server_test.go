@@ -0,0 +1,233 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func testServer(t *testing.T, roots ...string) *Server {
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.IndexPath = filepath.Join(dir, "index")
+	config.StringidsPath = filepath.Join(dir, "stringids")
+	config.Roots = roots
+	s := &Server{}
+	s.Init(config)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func touch(t *testing.T, path string) {
+	writeFile(t, path, "")
+}
+
+func writeFile(t *testing.T, path, contents string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func candidatePaths(cands []candidate) []string {
+	paths := make([]string, 0, len(cands))
+	for _, cand := range cands {
+		paths = append(paths, cand.path)
+	}
+	return paths
+}
+
+func contains(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAddRemoveRoot(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	file := filepath.Join(root, "pkg", "stringids.go")
+	touch(t, file)
+
+	s := testServer(t)
+	if _, err := s.AddRoot(filepath.Join(dir, "missing")); err == nil {
+		t.Error("added a root that does not exist")
+	}
+	if _, err := s.AddRoot(root); err != nil {
+		t.Fatal(err)
+	}
+	if !contains(s.FindMatches("stringids"), file) {
+		t.Errorf("%s not found after adding root", file)
+	}
+	roots, err := ReadRoots(s.config.RootsPath())
+	if err != nil || !contains(roots, root) {
+		t.Errorf("root not persisted: %v %v", roots, err)
+	}
+
+	// roots are compared cleaned up
+	if err := s.RemoveRoot(root + "/"); err != nil {
+		t.Fatal(err)
+	}
+	if contains(s.FindMatches("stringids"), file) {
+		t.Errorf("%s found after removing root", file)
+	}
+	if _, err := s.stringids.GetId(file); err == nil {
+		t.Errorf("%s still has an id after removing root", file)
+	}
+	if err := s.RemoveRoot(root); err == nil {
+		t.Error("removed a root twice")
+	}
+}
+
+func TestRootsOverride(t *testing.T) {
+	dir := t.TempDir()
+	added := filepath.Join(dir, "added")
+	flagged := filepath.Join(dir, "flagged")
+	touch(t, filepath.Join(added, "a.go"))
+	touch(t, filepath.Join(flagged, "b.go"))
+	s := testServer(t)
+	if _, err := s.AddRoot(added); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	config := *s.config
+	config.Roots = []string{flagged}
+	restarted := &Server{}
+	restarted.Init(&config)
+	defer restarted.Close()
+	if roots := restarted.Roots(); len(roots) != 1 || roots[0] != added {
+		t.Errorf("expected the roots added at runtime but got %v", roots)
+	}
+	restarted.Close()
+
+	config.RootsOverride = true
+	overridden := &Server{}
+	overridden.Init(&config)
+	defer overridden.Close()
+	if roots := overridden.Roots(); len(roots) != 1 || roots[0] != flagged {
+		t.Errorf("expected the roots given on the command line but got %v", roots)
+	}
+}
+
+func TestConcurrentQueriesAndIndexing(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 50; i++ {
+		touch(t, filepath.Join(dir, "root", fmt.Sprintf("matcher%d.go", i)))
+		touch(t, filepath.Join(dir, "other", fmt.Sprintf("matcher%d.go", i)))
+	}
+	s := testServer(t, filepath.Join(dir, "root"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				s.FindMatches("matcher")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			s.Index()
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.AddRoot(filepath.Join(dir, "other"))
+		s.RemoveRoot(filepath.Join(dir, "other"))
+	}()
+	wg.Wait()
+
+	if !contains(s.FindMatches("matcher1.go"), filepath.Join(dir, "root", "matcher1.go")) {
+		t.Error("matcher1.go not found after concurrent indexing")
+	}
+}
+
+func TestReindexDropsVanishedFiles(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "root", "oldname.go")
+	renamed := filepath.Join(dir, "root", "newname.go")
+	touch(t, old)
+	s := testServer(t, filepath.Join(dir, "root"))
+	if !contains(s.FindMatches("oldname"), old) {
+		t.Fatalf("%s not indexed", old)
+	}
+
+	if err := os.Rename(old, renamed); err != nil {
+		t.Fatal(err)
+	}
+	s.Index()
+	if contains(s.FindMatches("oldname"), old) {
+		t.Errorf("%s found after it was renamed", old)
+	}
+	if !contains(s.FindMatches("newname"), renamed) {
+		t.Errorf("%s not found after rename", renamed)
+	}
+	if _, err := s.stringids.GetId(old); err == nil {
+		t.Errorf("%s still has an id after it was renamed", old)
+	}
+}
+
+func TestRemovedBeforeIndexWasStored(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "root", "swapfile.go")
+	touch(t, file)
+	s := testServer(t, filepath.Join(dir, "root"))
+	id, err := s.stringids.GetId(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the watcher deleted the path from stringids, then the process died
+	// before the index was stored
+	if err := s.stringids.Delete(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	restarted := &Server{}
+	restarted.Init(s.config)
+	defer restarted.Close()
+	if contains(restarted.FindMatches("swapfile"), file) {
+		t.Errorf("%s found after it was deleted", file)
+	}
+	// without walking again
+	if restarted.current().ids()[id] {
+		t.Errorf("expected id %d to be dropped from the index", id)
+	}
+}
+
+func TestCorruptIndexIsRebuilt(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "root", "corrupted.go")
+	touch(t, file)
+	s := testServer(t, filepath.Join(dir, "root"))
+	s.Close()
+
+	bs, err := ioutil.ReadFile(s.config.IndexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs[len(bs)-1] ^= 0xFF
+	if err := ioutil.WriteFile(s.config.IndexPath, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := &Server{}
+	restarted.Init(s.config)
+	if !contains(restarted.FindMatches("corrupted"), file) {
+		t.Errorf("%s not found after restarting with a corrupt index", file)
+	}
+}
@@ -1,118 +1,568 @@
 package lib
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pankajroark/pathsearch/ds"
+)
+
+/*
+ Stringids keeps every path in a write ahead log and hands out dense ids,
+ 0, 1, 2 and so on in the order paths were added, so that posting lists stay
+ small and tables of paths can be indexed by id.
+
+	header:
+	  magic      "PSID"
+	  version    uint32
+	  generation uint64, new for every wal written from scratch
+	records:
+	  tag      uvarint
+	  string   tag>>1 bytes if tag&1 == 0, else the record is a tombstone
+	           and tag>>1 is the offset of the string it deletes
+	  checksum uint32, crc32c of the tag and string
+
+ A record is appended with a single write, a crash can still leave part of
+ one at the end. Opening the wal stops at the first record that is cut short
+ or fails its checksum and truncates the wal there, what follows it cannot be
+ trusted. How often the wal is synced to disk is up to the SyncPolicy, records
+ that were not synced can be lost with the machine but not with the process.
+
+ Strings are never removed from the wal, deleting one appends a tombstone
+ instead and its id is not handed out again. The id of a string is the number
+ of strings before it in the wal.
+
+ The offset of every id's record is kept in an array, also stored next to the
+ wal so that paths can be read by id without scanning the wal first:
+
+	header:
+	  magic      "PSIO"
+	  version    uint32
+	  generation uint64, of the wal
+	offsets: uint64 per id
+
+ It is appended to after the wal, a table that does not agree with the wal
+ when opened is written again from it.
+
+ Strings are found by their hash in a ds.IntHashTable from hashes to the
+ ids of live strings, deleting one drops its id from the table and sets its
+ bit in a bitmap. Both are saved from time to time in a checkpoint, along
+ with how much of the wal they cover, and only the wal after that is read
+ when opened:
+
+	header:
+	  magic      "PSCK"
+	  version    uint32
+	  checksum   uint32, crc32c of what follows
+	  offsets checksum uint32, crc32c of the offsets of the ids covered
+	  generation uint64, of the wal
+	  wal size   uint64, covered
+	  dead size  uint64
+	  count      uint64, of ids covered
+	deleted: count bits, in uint64s
+	table:   the buffer of the hash table
+
+ Wals written before the header existed had uint16 lengths and the ones of
+ version 2 no checksums, they are rewritten in this format when opened. Ids
+ change in the process, as they do when a wal is compacted, which is what the
+ generation tells users of the ids about.
+*/
+
+const (
+	walMagic      = "PSID"
+	walVersion    = 3
+	walHeaderSize = 4 + 4 + 8
+	// the old format marked tombstones with this length
+	oldTombstoneLen      = 0xFFFF
+	offsetsMagic         = "PSIO"
+	offsetsVersion       = 1
+	checkpointMagic      = "PSCK"
+	checkpointVersion    = 2
+	checkpointHeaderSize = 4 + 4 + 4 + 4 + 8 + 8 + 8 + 8
+	// opening checkpoints if it had to read more of the wal than this
+	checkpointMin = 1 << 20
+	checksumSize  = 4
+	// how long SyncInterval lets writes go unsynced
+	walSyncInterval = time.Second
+)
+
+// SyncPolicy says when writes to the wal are synced to disk.
+type SyncPolicy int
+
+const (
+	// SyncInterval syncs at most walSyncInterval after a write.
+	SyncInterval SyncPolicy = iota
+	// SyncAlways syncs every write before returning.
+	SyncAlways
+	// SyncNever leaves it to the operating system.
+	SyncNever
 )
 
-// Note that max size of string is 2bytes
+// ParseSyncPolicy parses a policy as given in the config, "always",
+// "interval" or "never". Empty is the default, interval.
+func ParseSyncPolicy(str string) (SyncPolicy, error) {
+	switch str {
+	case "", "interval":
+		return SyncInterval, nil
+	case "always":
+		return SyncAlways, nil
+	case "never":
+		return SyncNever, nil
+	}
+	return 0, fmt.Errorf("unknown fsync policy %q", str)
+}
+
+var (
+	errIdsFull    = errors.New("out of stringids ids")
+	errWalCorrupt = errors.New("corrupt stringids record")
+	errWalFormat  = errors.New("stringids wal in the old format")
+)
+
+// Stringids is safe for concurrent use, lookups share a read lock while Add,
+// Delete and Clear take it exclusively.
+type Stringids struct {
+	mu         sync.RWMutex
+	indexPath  string
+	wal        *os.File
+	walSize    int64
+	generation uint64
+	// bytes taken by deleted strings and their tombstones
+	deadSize int64
+	// by id, the offset of its record in the wal
+	offsets     []int64
+	offsetsFile *os.File
+	// set once writing to offsetsFile failed, it is written again on open
+	offsetsStale bool
+	// from hashes of strings to the ids of live ones
+	table ds.IntHashTable
+	// a bit by id, set if the string was deleted
+	deleted []uint64
+	policy  SyncPolicy
+	// set while a sync is scheduled, with SyncInterval
+	syncTimer *time.Timer
+	// users of s, it is closed once the last one releases it. Whoever
+	// created s is the first.
+	refs atomic.Int32
+}
+
+func NewStringids(path string, policy SyncPolicy) *Stringids {
+	wal, walSize, generation, e := openWal(path)
+	if e == errWalFormat {
+		fmt.Println("Migrating WAL...")
+		if e = migrateWal(path); e == nil {
+			wal, walSize, generation, e = openWal(path)
+		}
+	}
+	if e != nil {
+		panic(e)
+	}
+	strids := &Stringids{indexPath: path, wal: wal, walSize: walSize, generation: generation, policy: policy}
+	strids.refs.Store(1)
+	from := strids.loadCheckpoint()
+	strids.loadFromWal(from)
+	if e := strids.openOffsets(); e != nil {
+		panic(e)
+	}
+	if strids.walSize-from > checkpointMin {
+		if e := strids.Checkpoint(); e != nil {
+			log.Printf("failed to checkpoint stringids: %v", e)
+		}
+	}
+	return strids
+}
+
+// openWal opens the wal at path, creating it if there is none, and returns
+// its size and generation.
+func openWal(path string) (*os.File, int64, uint64, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// the header is written atomically, a wal never has only part of one
+		if err := ds.WriteFileAtomic(path, walHeader(walMagic, walVersion, uint64(time.Now().UnixNano())), 0660); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	wal, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0660)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	fi, err := wal.Stat()
+	if err != nil {
+		wal.Close()
+		return nil, 0, 0, err
+	}
+	header := make([]byte, walHeaderSize)
+	n, _ := wal.ReadAt(header, 0)
+	if n < len(walMagic) || string(header[:len(walMagic)]) != walMagic {
+		wal.Close()
+		if fi.Size() == 0 {
+			// nothing to migrate
+			os.Remove(path)
+			return openWal(path)
+		}
+		return nil, 0, 0, errWalFormat
+	}
+	if n < walHeaderSize {
+		wal.Close()
+		return nil, 0, 0, errWalCorrupt
+	}
+	if version := binary.LittleEndian.Uint32(header[4:8]); version < walVersion {
+		wal.Close()
+		return nil, 0, 0, errWalFormat
+	} else if version != walVersion {
+		wal.Close()
+		return nil, 0, 0, fmt.Errorf("unsupported stringids version %d", version)
+	}
+	return wal, fi.Size(), binary.LittleEndian.Uint64(header[8:16]), nil
+}
+
+// walHeader returns the header of the wal and of its offsets file, they
+// differ only in magic and version.
+func walHeader(magic string, version uint32, generation uint64) []byte {
+	header := make([]byte, walHeaderSize)
+	copy(header, magic)
+	binary.LittleEndian.PutUint32(header[4:8], version)
+	binary.LittleEndian.PutUint64(header[8:16], generation)
+	return header
+}
 
-type Node struct {
-	offset uint32
-	next   *Node
+func (s *Stringids) offsetsPath() string {
+	return s.indexPath + ".ids"
 }
 
-type OffsetTable struct {
-	offsetTable []*Node
-	size        uint32
+// openOffsets opens the stored offsets, writing them out first unless they
+// match the ones read from the wal.
+func (s *Stringids) openOffsets() error {
+	path := s.offsetsPath()
+	header := walHeader(offsetsMagic, offsetsVersion, s.generation)
+	bs, err := ioutil.ReadFile(path)
+	if err != nil || !s.offsetsMatch(header, bs) {
+		bs = make([]byte, walHeaderSize, walHeaderSize+8*len(s.offsets))
+		copy(bs, header)
+		for _, offset := range s.offsets {
+			bs = binary.LittleEndian.AppendUint64(bs, uint64(offset))
+		}
+		if err := ds.WriteFileAtomic(path, bs, 0660); err != nil {
+			return err
+		}
+	}
+	s.offsetsFile, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0660)
+	return err
 }
 
-func NewOffsetTable(capacity uint32) *OffsetTable {
-	ot := make([]*Node, capacity)
-	o := OffsetTable{offsetTable: ot, size: 0}
-	return &o
+func (s *Stringids) offsetsMatch(header, bs []byte) bool {
+	if len(bs) != walHeaderSize+8*len(s.offsets) || string(bs[:walHeaderSize]) != string(header) {
+		return false
+	}
+	for id, offset := range s.offsets {
+		if binary.LittleEndian.Uint64(bs[walHeaderSize+8*id:]) != uint64(offset) {
+			return false
+		}
+	}
+	return true
 }
 
-func (t *OffsetTable) capacity() uint32 {
-	return uint32(len(t.offsetTable))
+// encodeRecord returns the record with tag and str.
+func encodeRecord(tag uint64, str string) []byte {
+	ba := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(str)+checksumSize)
+	ba = append(ba[:binary.PutUvarint(ba, tag)], str...)
+	return binary.LittleEndian.AppendUint32(ba, crc32.Checksum(ba, castagnoli))
 }
 
-func (t *OffsetTable) put(hash, offset uint32) {
-	slot := hash % uint32(len(t.offsetTable))
-	t.offsetTable[slot] = &Node{offset: offset, next: t.offsetTable[slot]}
-	t.size += 1
+// recordSize returns the size of the record of a string of length n.
+func recordSize(n int) int64 {
+	var ba [binary.MaxVarintLen64]byte
+	return int64(binary.PutUvarint(ba[:], uint64(n)<<1) + n + checksumSize)
 }
 
-func (t *OffsetTable) get(hash uint32) *Node {
-	slot := hash % uint32(len(t.offsetTable))
-	return t.offsetTable[slot]
+func tombstoneSize(offset int64) int64 {
+	var ba [binary.MaxVarintLen64]byte
+	return int64(binary.PutUvarint(ba[:], uint64(offset)<<1|1) + checksumSize)
 }
 
-func (t *OffsetTable) rehashNeeded() bool {
-	return float64(t.size) > 0.9*float64(len(t.offsetTable))
+func (s *Stringids) checkpointPath() string {
+	return s.indexPath + ".checkpoint"
 }
 
-func (t *OffsetTable) forAll(f func(uint32)) {
-	var i uint32
-	for i = 0; i < t.capacity(); i++ {
-		node := t.offsetTable[i]
-		for node != nil {
-			f(node.offset)
-			node = node.next
+// loadCheckpoint restores the state saved by Checkpoint, if there is one for
+// the wal, and returns the offset in the wal up to which it is restored.
+func (s *Stringids) loadCheckpoint() int64 {
+	s.table = ds.CreateIntHashTable(1024)
+	s.offsets, s.deleted, s.deadSize = nil, nil, 0
+	bs, err := ioutil.ReadFile(s.checkpointPath())
+	if err != nil || len(bs) < checkpointHeaderSize || string(bs[:4]) != checkpointMagic ||
+		binary.LittleEndian.Uint32(bs[4:8]) != checkpointVersion ||
+		binary.LittleEndian.Uint32(bs[8:12]) != crc32.Checksum(bs[12:], castagnoli) ||
+		binary.LittleEndian.Uint64(bs[16:24]) != s.generation {
+		return walHeaderSize
+	}
+	walSize := int64(binary.LittleEndian.Uint64(bs[24:32]))
+	deadSize := int64(binary.LittleEndian.Uint64(bs[32:40]))
+	count := binary.LittleEndian.Uint64(bs[40:48])
+	words := (count + 63) / 64
+	if walSize > s.walSize || count > uint64(s.walSize) || 8*words > uint64(len(bs)-checkpointHeaderSize) {
+		// the wal lost what the checkpoint covers
+		return walHeaderSize
+	}
+	offsets, err := ioutil.ReadFile(s.offsetsPath())
+	if err != nil || uint64(len(offsets)) < walHeaderSize+8*count ||
+		string(offsets[:walHeaderSize]) != string(walHeader(offsetsMagic, offsetsVersion, s.generation)) {
+		return walHeaderSize
+	}
+	offsets = offsets[walHeaderSize : walHeaderSize+8*count]
+	if crc32.Checksum(offsets, castagnoli) != binary.LittleEndian.Uint32(bs[12:16]) {
+		return walHeaderSize
+	}
+	body := bs[checkpointHeaderSize:]
+	table, err := ds.IntHashTableFromBytes(body[8*words:])
+	if err != nil {
+		return walHeaderSize
+	}
+	s.table = table
+	s.offsets = make([]int64, count)
+	for id := range s.offsets {
+		s.offsets[id] = int64(binary.LittleEndian.Uint64(offsets[8*id:]))
+	}
+	s.deleted = make([]uint64, words)
+	for i := range s.deleted {
+		s.deleted[i] = binary.LittleEndian.Uint64(body[8*i:])
+	}
+	s.deadSize = deadSize
+	return walSize
+}
+
+// Checkpoint syncs the wal and saves what was read from it, so that opening
+// it again only has to read what was written after.
+func (s *Stringids) Checkpoint() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.syncTimer != nil {
+		s.syncTimer.Stop()
+		s.syncTimer = nil
+	}
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+	words := (len(s.offsets) + 63) / 64
+	table := s.table.Bytes()
+	bs := make([]byte, checkpointHeaderSize, checkpointHeaderSize+8*words+len(table))
+	copy(bs, checkpointMagic)
+	binary.LittleEndian.PutUint32(bs[4:8], checkpointVersion)
+	offsets := make([]byte, 0, 8*len(s.offsets))
+	for _, offset := range s.offsets {
+		offsets = binary.LittleEndian.AppendUint64(offsets, uint64(offset))
+	}
+	binary.LittleEndian.PutUint32(bs[12:16], crc32.Checksum(offsets, castagnoli))
+	binary.LittleEndian.PutUint64(bs[16:24], s.generation)
+	binary.LittleEndian.PutUint64(bs[24:32], uint64(s.walSize))
+	binary.LittleEndian.PutUint64(bs[32:40], uint64(s.deadSize))
+	binary.LittleEndian.PutUint64(bs[40:48], uint64(len(s.offsets)))
+	for i := 0; i < words; i++ {
+		var word uint64
+		if i < len(s.deleted) {
+			word = s.deleted[i]
 		}
+		bs = binary.LittleEndian.AppendUint64(bs, word)
 	}
+	bs = append(bs, table...)
+	binary.LittleEndian.PutUint32(bs[8:12], crc32.Checksum(bs[12:], castagnoli))
+	return ds.WriteFileAtomic(s.checkpointPath(), bs, 0660)
 }
 
-type Stringids struct {
-	indexPath   string
-	wal         *os.File
-	walSize     uint32
-	offsetTable *OffsetTable
+func (s *Stringids) isDeleted(id uint32) bool {
+	return int(id/64) < len(s.deleted) && s.deleted[id/64]&(1<<(id%64)) != 0
 }
 
-func NewStringids(path string) *Stringids {
-	wal, _ := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0660)
-	fi, e := wal.Stat()
-	if e != nil {
-		panic(e)
+func (s *Stringids) markDeleted(id uint32) {
+	for int(id/64) >= len(s.deleted) {
+		s.deleted = append(s.deleted, 0)
 	}
-	walSize := uint32(fi.Size())
-	offsetTable := NewOffsetTable(1024)
-	strids := &Stringids{indexPath: path, wal: wal, walSize: walSize, offsetTable: offsetTable}
-	// todo read wal here
-	strids.loadOffsetTableFromWal()
-	return strids
+	s.deleted[id/64] |= 1 << (id % 64)
 }
 
-func (s *Stringids) loadOffsetTableFromWal() {
+// loadFromWal reads the records of the wal from offset on and truncates it
+// after the last one that checks out.
+func (s *Stringids) loadFromWal(offset int64) {
 	fmt.Println("Reading WAL...")
-	var offset uint32
-	offset = 0
-	for {
-		str, e := s.StrAtOffset(offset)
+	r := bufio.NewReaderSize(io.NewSectionReader(s.wal, offset, s.walSize-offset), 1<<16)
+	var ba [binary.MaxVarintLen64]byte
+	var sum [checksumSize]byte
+	for offset < s.walSize {
+		tag, e := binary.ReadUvarint(r)
 		if e != nil {
 			break
 		}
-		s.storeOffset(str, offset)
-		offset += uint32(len(str) + 2)
+		size := uint64(0)
+		if tag&1 == 0 {
+			size = tag >> 1
+		}
+		if size > uint64(s.walSize-offset) {
+			break
+		}
+		record := append(ba[:binary.PutUvarint(ba[:], tag)], make([]byte, size)...)
+		str := record[len(record)-int(size):]
+		if _, e := io.ReadFull(r, str); e != nil {
+			break
+		}
+		if _, e := io.ReadFull(r, sum[:]); e != nil {
+			break
+		}
+		if binary.LittleEndian.Uint32(sum[:]) != crc32.Checksum(record, castagnoli) {
+			break
+		}
+		if tag&1 == 1 {
+			deleted := int64(tag >> 1)
+			id, found := s.idAt(deleted)
+			if !found {
+				break
+			}
+			deletedStr, e := s.strAtOffset(deleted)
+			if e != nil || s.isDeleted(id) {
+				break
+			}
+			s.markDeleted(id)
+			s.table.DeleteValue(s.hash(deletedStr), id)
+			s.deadSize += recordSize(len(deletedStr)) + tombstoneSize(deleted)
+			offset += tombstoneSize(deleted)
+			continue
+		}
+		s.offsets = append(s.offsets, offset)
+		s.storeId(string(str), uint32(len(s.offsets)-1))
+		offset += recordSize(len(str))
+	}
+	if offset < s.walSize {
+		fmt.Printf("Truncating WAL from %d to %d bytes, the rest is torn or corrupt\n", s.walSize, offset)
+		if e := s.wal.Truncate(offset); e != nil {
+			panic(e)
+		}
+		s.walSize = offset
 	}
 	fmt.Println("Finished reading WAL...")
 }
 
-func (s *Stringids) rehash() {
-	fmt.Println("rehashing...")
-	nt := NewOffsetTable(2 * s.offsetTable.capacity())
-	anon := func(offset uint32) {
-		str, _ := s.StrAtOffset(offset)
-		h := s.hash(str)
-		nt.put(h, offset)
+// idAt returns the id of the string with its record at offset.
+func (s *Stringids) idAt(offset int64) (uint32, bool) {
+	i := sort.Search(len(s.offsets), func(i int) bool { return s.offsets[i] >= offset })
+	return uint32(i), i < len(s.offsets) && s.offsets[i] == offset
+}
+
+// migrateWal rewrites the wal at path from an older format, keeping only the
+// strings that were not deleted.
+func migrateWal(path string) error {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	strs := make(map[int]string)
+	offsets := make([]int, 0)
+	if len(bs) >= walHeaderSize && string(bs[:len(walMagic)]) == walMagic {
+		// version 2, records without checksums
+		for offset := walHeaderSize; offset < len(bs); {
+			tag, n := binary.Uvarint(bs[offset:])
+			if n <= 0 {
+				break
+			}
+			if tag&1 == 1 {
+				delete(strs, int(tag>>1))
+				offset += n
+				continue
+			}
+			if tag>>1 > uint64(len(bs)-offset-n) {
+				break
+			}
+			strs[offset] = string(bs[offset+n : offset+n+int(tag>>1)])
+			offsets = append(offsets, offset)
+			offset += n + int(tag>>1)
+		}
+	} else {
+		// no header, uint16 lengths
+		for offset := 0; offset+2 <= len(bs); {
+			size := int(binary.LittleEndian.Uint16(bs[offset:]))
+			if size == oldTombstoneLen {
+				if offset+6 > len(bs) {
+					break
+				}
+				delete(strs, int(binary.LittleEndian.Uint32(bs[offset+2:])))
+				offset += 6
+				continue
+			}
+			if offset+2+size > len(bs) {
+				break
+			}
+			strs[offset] = string(bs[offset+2 : offset+2+size])
+			offsets = append(offsets, offset)
+			offset += 2 + size
+		}
 	}
-	s.offsetTable.forAll(anon)
-	s.offsetTable = nt
+	live := make([]string, 0, len(strs))
+	for _, offset := range offsets {
+		if str, found := strs[offset]; found {
+			live = append(live, str)
+		}
+	}
+	return writeWal(path, len(live), func(i int) (string, error) {
+		return live[i], nil
+	})
+}
+
+// writeWal replaces path with a new wal holding n strings, in order, so
+// that the i'th gets id i.
+func writeWal(path string, n int, str func(i int) (string, error)) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	w := bufio.NewWriter(f)
+	w.Write(walHeader(walMagic, walVersion, uint64(time.Now().UnixNano())))
+	for i := 0; i < n && err == nil; i++ {
+		var s string
+		if s, err = str(i); err != nil {
+			break
+		}
+		w.Write(encodeRecord(uint64(len(s))<<1, s))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
 }
 
 func (s *Stringids) reset() {
-	s.wal, _ = os.OpenFile(s.indexPath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0660)
-	fi, e := s.wal.Stat()
+	var e error
+	s.wal, s.walSize, s.generation, e = openWal(s.indexPath)
 	if e != nil {
 		panic(e)
 	}
-	s.walSize = uint32(fi.Size())
-	s.offsetTable = NewOffsetTable(s.offsetTable.capacity())
+	s.loadCheckpoint()
+	if e := s.openOffsets(); e != nil {
+		panic(e)
+	}
 }
 
 func (s *Stringids) hash(str string) uint32 {
@@ -124,64 +574,235 @@ func (s *Stringids) hash(str string) uint32 {
 	return hash.Sum32()
 }
 
-func (s *Stringids) writeToWal(str string) uint32 {
+// writeToWal appends the record with tag and str and syncs it as the policy
+// says. A record that fails to be written is cut off again, so that the
+// records after it can be read.
+func (s *Stringids) writeToWal(tag uint64, str string) error {
+	record := encodeRecord(tag, str)
+	if _, err := s.wal.Write(record); err != nil {
+		s.wal.Truncate(s.walSize)
+		return err
+	}
+	s.walSize += int64(len(record))
+	switch s.policy {
+	case SyncAlways:
+		return s.wal.Sync()
+	case SyncInterval:
+		if s.syncTimer == nil {
+			s.syncTimer = time.AfterFunc(walSyncInterval, func() {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				s.syncTimer = nil
+				s.wal.Sync()
+			})
+		}
+	}
+	return nil
+}
+
+func (s *Stringids) storeId(str string, id uint32) {
+	s.table.Add(s.hash(str), id)
+}
+
+// Add returns the id of str, adding it if it is not there yet.
+func (s *Stringids) Add(str string) (uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, err := s.getId(str)
+	if err == nil {
+		return id, nil
+	}
+	if uint64(len(s.offsets)) > math.MaxUint32 {
+		return 0, errIdsFull
+	}
 	offset := s.walSize
-	binary.Write(s.wal, binary.LittleEndian, uint16(len(str)))
-	n, err := s.wal.Write([]byte(str))
-	if err != nil {
-		panic(err)
+	if err := s.writeToWal(uint64(len(str))<<1, str); err != nil {
+		return 0, err
+	}
+	id = uint32(len(s.offsets))
+	s.offsets = append(s.offsets, offset)
+	s.storeId(str, id)
+	// the id is in the wal, stored offsets that fall behind or are cut
+	// short are written again on open
+	if !s.offsetsStale {
+		var ba [8]byte
+		binary.LittleEndian.PutUint64(ba[:], uint64(offset))
+		if _, err := s.offsetsFile.Write(ba[:]); err != nil {
+			log.Printf("failed to store stringids offsets, they are rewritten on open: %v", err)
+			s.offsetsStale = true
+		}
 	}
-	s.walSize += uint32(n) + 2 // 2 bytes for size
-	return offset
+	return id, nil
 }
 
-func (s *Stringids) storeOffset(str string, offset uint32) {
-	s.offsetTable.put(s.hash(str), offset)
-	if s.offsetTable.rehashNeeded() {
-		s.rehash()
+// Delete marks str as deleted, the id it had is never handed out again.
+func (s *Stringids) Delete(str string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, err := s.getId(str)
+	if err != nil {
+		return err
+	}
+	offset := s.offsets[id]
+	if err := s.writeToWal(uint64(offset)<<1|1, ""); err != nil {
+		return err
 	}
+	s.deadSize += recordSize(len(str)) + tombstoneSize(offset)
+	s.markDeleted(id)
+	s.table.DeleteValue(s.hash(str), id)
+	return nil
 }
 
-func (s *Stringids) Add(str string) uint32 {
-	offset, err := s.GetOffset(str)
+// Size returns the size of the wal and how much of it is taken by deleted
+// strings, which Compact would reclaim.
+func (s *Stringids) Size() (size, dead int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.walSize, s.deadSize
+}
+
+// Generation identifies the wal, ids from one generation mean nothing in
+// another.
+func (s *Stringids) Generation() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.generation
+}
+
+// CompactTo writes a wal with only the live strings to path and returns the
+// id every live string has there by its id here. Strings keep their order,
+// so a sorted list of ids is still sorted once mapped. s itself is left as it
+// is, the caller moves the new wal in place and opens it.
+func (s *Stringids) CompactTo(path string) (map[uint32]uint32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := make([]uint32, 0, len(s.offsets))
+	for id := range s.offsets {
+		if !s.isDeleted(uint32(id)) {
+			ids = append(ids, uint32(id))
+		}
+	}
+
+	err := writeWal(path, len(ids), func(i int) (string, error) {
+		return s.strAt(ids[i])
+	})
 	if err != nil {
-		offset = s.writeToWal(str)
-		s.storeOffset(str, offset)
+		return nil, err
+	}
+	remap := make(map[uint32]uint32, len(ids))
+	for i, id := range ids {
+		remap[id] = uint32(i)
 	}
-	return offset
+	return remap, nil
 }
 
-func (s *Stringids) StrAtOffset(offset uint32) (string, error) {
-	var size uint16
-	ba := make([]byte, 2)
-	_, e := s.wal.ReadAt(ba, int64(offset))
-	if e != nil {
+// Deleted reports whether the string with id was deleted.
+func (s *Stringids) Deleted(id uint32) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.isDeleted(id)
+}
+
+// StrAt returns the string with id, deleted or not.
+func (s *Stringids) StrAt(id uint32) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.strAt(id)
+}
+
+func (s *Stringids) strAt(id uint32) (string, error) {
+	if int64(id) >= int64(len(s.offsets)) {
+		return "", errors.New("no such id")
+	}
+	return s.strAtOffset(s.offsets[id])
+}
+
+func (s *Stringids) strAtOffset(offset int64) (string, error) {
+	if offset < walHeaderSize || offset >= s.walSize {
+		return "", errWalCorrupt
+	}
+	// most paths fit in the first read
+	ba := make([]byte, 256)
+	n, e := s.wal.ReadAt(ba, offset)
+	if n == 0 {
 		return "", e
 	}
-	reader := bytes.NewReader(ba)
-	binary.Read(reader, binary.LittleEndian, &size)
+	tag, m := binary.Uvarint(ba[:n])
+	if m <= 0 {
+		return "", errWalCorrupt
+	}
+	if tag&1 == 1 {
+		return "", errors.New("tombstone")
+	}
+	size := tag >> 1
+	if size > uint64(s.walSize-offset-int64(m)) {
+		return "", errWalCorrupt
+	}
+	if uint64(n-m) >= size {
+		return string(ba[m : m+int(size)]), nil
+	}
 	ba = make([]byte, size)
-	offset += 2
-	s.wal.ReadAt(ba, int64(offset))
+	if _, e := s.wal.ReadAt(ba, offset+int64(m)); e != nil {
+		return "", e
+	}
 	return string(ba), nil
 }
 
-func (s *Stringids) GetOffset(str string) (uint32, error) {
-	node := s.offsetTable.get(s.hash(str))
-	for node != nil {
-		tstr, _ := s.StrAtOffset(node.offset)
-		if tstr == str {
-			return node.offset, nil
+func (s *Stringids) GetId(str string) (uint32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getId(str)
+}
+
+func (s *Stringids) getId(str string) (uint32, error) {
+	found, ok := uint32(0), false
+	s.table.GetAll(s.hash(str), func(id uint32) bool {
+		if tstr, _ := s.strAt(id); tstr == str {
+			found, ok = id, true
+			return false
 		}
-		node = node.next
+		return true
+	})
+	if !ok {
+		return 0, errors.New("not found")
+	}
+	return found, nil
+}
+
+func (s *Stringids) retain() {
+	s.refs.Add(1)
+}
+
+// release closes s once every user released it.
+func (s *Stringids) release() {
+	if s.refs.Add(-1) == 0 {
+		s.Close()
+	}
+}
+
+// Close stops a pending sync and closes the files of s, which must not be
+// used after.
+func (s *Stringids) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.syncTimer != nil {
+		s.syncTimer.Stop()
+		s.syncTimer = nil
 	}
-	return 0, errors.New("not found")
+	s.offsetsFile.Close()
+	return s.wal.Close()
 }
 
 func (s *Stringids) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wal.Close()
+	s.offsetsFile.Close()
 	err := os.Remove(s.indexPath)
 	if err != nil {
 		panic(err)
 	}
+	os.Remove(s.offsetsPath())
+	os.Remove(s.checkpointPath())
 	s.reset()
 }
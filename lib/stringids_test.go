@@ -0,0 +1,362 @@
+package lib
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mustAdd(t *testing.T, s *Stringids, str string) uint32 {
+	id, err := s.Add(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestStringidsDeleteSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stringids")
+	s := NewStringids(path, SyncNever)
+	a := mustAdd(t, s, "/a/b")
+	mustAdd(t, s, "/a/c")
+	if err := s.Delete("/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetId("/a/b"); err == nil {
+		t.Error("deleted string still found")
+	}
+
+	s = NewStringids(path, SyncNever)
+	if _, err := s.GetId("/a/b"); err == nil {
+		t.Error("deleted string found after reopen")
+	}
+	if _, err := s.GetId("/a/c"); err != nil {
+		t.Error("live string lost after reopen")
+	}
+	if b := mustAdd(t, s, "/a/b"); b == a {
+		t.Error("deleted offset handed out again")
+	}
+}
+
+func TestStringidsCompactTo(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStringids(filepath.Join(dir, "stringids"), SyncNever)
+	a := mustAdd(t, s, "/a")
+	b := mustAdd(t, s, "/b")
+	c := mustAdd(t, s, "/c")
+	if err := s.Delete("/b"); err != nil {
+		t.Fatal(err)
+	}
+	remap, err := s.CompactTo(filepath.Join(dir, "compacted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := remap[b]; found || len(remap) != 2 {
+		t.Errorf("unexpected remap %v", remap)
+	}
+	if remap[a] >= remap[c] {
+		t.Errorf("expected the order of offsets to be kept but got %v", remap)
+	}
+	compacted := NewStringids(filepath.Join(dir, "compacted"), SyncNever)
+	for old, str := range map[uint32]string{a: "/a", c: "/c"} {
+		if got, err := compacted.StrAt(remap[old]); err != nil || got != str {
+			t.Errorf("expected %s but got %s, %v", str, got, err)
+		}
+	}
+	if size, dead := compacted.Size(); size != walHeaderSize+2*recordSize(2) || dead != 0 {
+		t.Errorf("expected %d bytes with none dead but got %d and %d", walHeaderSize+2*recordSize(2), size, dead)
+	}
+	if compacted.Generation() == s.Generation() {
+		t.Error("expected the compacted wal to be a new generation")
+	}
+}
+
+func TestStringidsLongPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stringids")
+	s := NewStringids(path, SyncNever)
+	long := "/" + strings.Repeat("x", 100000)
+	id := mustAdd(t, s, long)
+	after := mustAdd(t, s, "/after")
+	if err := s.Delete(long); err != nil {
+		t.Fatal(err)
+	}
+	long2 := long + "y"
+	id2 := mustAdd(t, s, long2)
+
+	s = NewStringids(path, SyncNever)
+	if got, err := s.StrAt(id2); err != nil || got != long2 {
+		t.Errorf("expected a path of %d bytes but got %d, %v", len(long2), len(got), err)
+	}
+	if got, err := s.GetId("/after"); err != nil || got != after {
+		t.Errorf("expected %d but got %d, %v", after, got, err)
+	}
+	if _, err := s.GetId(long); err == nil {
+		t.Error("deleted long path found after reopen")
+	}
+	if _, dead := s.Size(); dead != recordSize(len(long))+tombstoneSize(s.offsets[id]) {
+		t.Errorf("unexpected dead size %d", dead)
+	}
+}
+
+func TestStringidsMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stringids")
+	old := make([]byte, 0)
+	offsets := make([]uint32, 0)
+	for _, str := range []string{"/a", "/b", "/c"} {
+		offsets = append(offsets, uint32(len(old)))
+		old = binary.LittleEndian.AppendUint16(old, uint16(len(str)))
+		old = append(old, str...)
+	}
+	old = binary.LittleEndian.AppendUint16(old, oldTombstoneLen)
+	old = binary.LittleEndian.AppendUint32(old, offsets[1])
+	if err := ioutil.WriteFile(path, old, 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStringids(path, SyncNever)
+	for _, str := range []string{"/a", "/c"} {
+		if _, err := s.GetId(str); err != nil {
+			t.Errorf("%s lost in the migration", str)
+		}
+	}
+	if _, err := s.GetId("/b"); err == nil {
+		t.Error("deleted string found after the migration")
+	}
+	if size, dead := s.Size(); size != walHeaderSize+2*recordSize(2) || dead != 0 {
+		t.Errorf("expected %d bytes with none dead but got %d and %d", walHeaderSize+2*recordSize(2), size, dead)
+	}
+}
+
+func TestStringidsDenseIds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stringids")
+	s := NewStringids(path, SyncNever)
+	for i, str := range []string{"/a", "/b", "/c"} {
+		if id := mustAdd(t, s, str); id != uint32(i) {
+			t.Errorf("expected id %d for %s but got %d", i, str, id)
+		}
+	}
+	if err := s.Delete("/b"); err != nil {
+		t.Fatal(err)
+	}
+	if id := mustAdd(t, s, "/d"); id != 3 {
+		t.Errorf("expected id 3 but got %d", id)
+	}
+
+	// the stored offsets lag behind, as if the process died before writing
+	// the last one
+	if err := os.Truncate(s.offsetsPath(), walHeaderSize+8*3); err != nil {
+		t.Fatal(err)
+	}
+	s = NewStringids(path, SyncNever)
+	for i, str := range []string{"/a", "/b", "/c", "/d"} {
+		if got, err := s.StrAt(uint32(i)); err != nil || got != str {
+			t.Errorf("expected %s but got %s, %v", str, got, err)
+		}
+	}
+	fi, err := os.Stat(s.offsetsPath())
+	if err != nil || fi.Size() != walHeaderSize+8*4 {
+		t.Errorf("expected the offsets to be written again but got %v, %v", fi, err)
+	}
+	if id := mustAdd(t, s, "/e"); id != 4 {
+		t.Errorf("expected id 4 but got %d", id)
+	}
+
+	// failing to store an offset does not fail the add, the id is in the wal
+	s.offsetsFile.Close()
+	if id := mustAdd(t, s, "/f"); id != 5 {
+		t.Errorf("expected id 5 but got %d", id)
+	}
+	s.Close()
+	s = NewStringids(path, SyncNever)
+	defer s.Close()
+	if got, err := s.StrAt(5); err != nil || got != "/f" {
+		t.Errorf("expected /f but got %s, %v", got, err)
+	}
+}
+
+func TestStringidsMigrateVersion2(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stringids")
+	old := walHeader(walMagic, 2, 1)
+	b := len(old) + 3
+	old = append(old, 2<<1, '/', 'a', 2<<1, '/', 'b')
+	old = binary.AppendUvarint(old, uint64(b)<<1|1)
+	if err := ioutil.WriteFile(path, old, 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStringids(path, SyncNever)
+	if id, err := s.GetId("/a"); err != nil || id != 0 {
+		t.Errorf("expected /a to get id 0 but got %d, %v", id, err)
+	}
+	if _, err := s.GetId("/b"); err == nil {
+		t.Error("deleted string found after the migration")
+	}
+	if s.Generation() == 1 {
+		t.Error("expected the migrated wal to be a new generation")
+	}
+}
+
+func TestStringidsTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stringids")
+	s := NewStringids(path, SyncAlways)
+	mustAdd(t, s, "/a")
+	mustAdd(t, s, "/b")
+	size, _ := s.Size()
+
+	// half of a record, as if the process died while writing it
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encodeRecord(2<<1, "/c")[:3])
+	f.Close()
+	s = NewStringids(path, SyncNever)
+	if got, _ := s.Size(); got != size {
+		t.Errorf("expected the torn record to be truncated to %d bytes but got %d", size, got)
+	}
+	if id := mustAdd(t, s, "/c"); id != 2 {
+		t.Errorf("expected id 2 but got %d", id)
+	}
+	s = NewStringids(path, SyncNever)
+	for i, str := range []string{"/a", "/b", "/c"} {
+		if got, err := s.StrAt(uint32(i)); err != nil || got != str {
+			t.Errorf("expected %s but got %s, %v", str, got, err)
+		}
+	}
+
+	// a flipped bit in /b drops it and everything after it
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs[walHeaderSize+recordSize(2)+2] ^= 1
+	if err := ioutil.WriteFile(path, bs, 0660); err != nil {
+		t.Fatal(err)
+	}
+	s = NewStringids(path, SyncNever)
+	if _, err := s.GetId("/a"); err != nil {
+		t.Error("/a lost to the corruption after it")
+	}
+	if _, err := s.GetId("/c"); err == nil {
+		t.Error("expected /c to be dropped after a corrupt record")
+	}
+	if got, _ := s.Size(); got != walHeaderSize+recordSize(2) {
+		t.Errorf("expected %d bytes but got %d", walHeaderSize+recordSize(2), got)
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for str, expected := range map[string]SyncPolicy{"": SyncInterval, "always": SyncAlways, "interval": SyncInterval, "never": SyncNever} {
+		if got, err := ParseSyncPolicy(str); err != nil || got != expected {
+			t.Errorf("%q: expected %d but got %d, %v", str, expected, got, err)
+		}
+	}
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Error("expected an unknown policy to be an error")
+	}
+}
+
+func TestStringidsCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stringids")
+	s := NewStringids(path, SyncNever)
+	for _, str := range []string{"/a", "/b", "/c"} {
+		mustAdd(t, s, str)
+	}
+	if err := s.Delete("/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	covered, dead := s.Size()
+	mustAdd(t, s, "/d")
+	if err := s.Delete("/c"); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &Stringids{indexPath: path, generation: s.generation, walSize: s.walSize}
+	if from := restored.loadCheckpoint(); from != covered || restored.deadSize != dead {
+		t.Errorf("expected the checkpoint to cover %d bytes but got %d", covered, from)
+	}
+	check := func(s *Stringids) {
+		for str, live := range map[string]bool{"/a": true, "/b": false, "/c": false, "/d": true} {
+			if _, err := s.GetId(str); (err == nil) != live {
+				t.Errorf("expected %s to be live %v but got %v", str, live, err)
+			}
+		}
+		if id := mustAdd(t, s, "/e"); id != 4 {
+			t.Errorf("expected id 4 but got %d", id)
+		}
+	}
+	check(NewStringids(path, SyncNever))
+
+	// a wal shorter than the checkpoint makes it useless
+	if err := os.Truncate(path, walHeaderSize+recordSize(2)); err != nil {
+		t.Fatal(err)
+	}
+	s = NewStringids(path, SyncNever)
+	if _, err := s.GetId("/a"); err != nil {
+		t.Error("/a lost")
+	}
+	if _, err := s.GetId("/d"); err == nil {
+		t.Error("found /d after the wal was truncated before it")
+	}
+}
+
+func TestStringidsChurnKeepsTableSmall(t *testing.T) {
+	s := NewStringids(filepath.Join(t.TempDir(), "stringids"), SyncNever)
+	mustAdd(t, s, "/a")
+	size := len(s.table.Bytes())
+	// an editor's swap file, created and deleted over and over
+	for i := 0; i < 1000; i++ {
+		mustAdd(t, s, "/a.swp")
+		if err := s.Delete("/a.swp"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.table.Len() != 1 {
+		t.Errorf("expected 1 id in the table but got %d", s.table.Len())
+	}
+	if len(s.table.Bytes()) != size {
+		t.Errorf("expected the table to stay at %d bytes but got %d", size, len(s.table.Bytes()))
+	}
+}
+
+func TestStringidsOffsetsPast4GiB(t *testing.T) {
+	s := NewStringids(filepath.Join(t.TempDir(), "stringids"), SyncNever)
+	s.offsets = []int64{walHeaderSize, 5 << 30, 6 << 30}
+	if id, found := s.idAt(5 << 30); !found || id != 1 {
+		t.Errorf("expected id 1 but got %d, %v", id, found)
+	}
+	if _, found := s.idAt(5<<30 + 1); found {
+		t.Error("found an id for an offset no record starts at")
+	}
+	// a tombstone for a record past 4GiB keeps the whole offset
+	record := encodeRecord(uint64(6<<30)<<1|1, "")
+	if tag, _ := binary.Uvarint(record); int64(tag>>1) != 6<<30 {
+		t.Errorf("expected offset %d but got %d", int64(6<<30), tag>>1)
+	}
+	if int64(len(record)) != tombstoneSize(6<<30) {
+		t.Errorf("expected a tombstone of %d bytes but got %d", tombstoneSize(6<<30), len(record))
+	}
+}
+
+func TestStringidsClose(t *testing.T) {
+	s := NewStringids(filepath.Join(t.TempDir(), "stringids"), SyncInterval)
+	mustAdd(t, s, "/a")
+	if s.syncTimer == nil {
+		t.Fatal("expected a sync to be scheduled")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s.syncTimer != nil {
+		t.Error("expected the scheduled sync to be stopped")
+	}
+	if _, err := s.wal.Stat(); err == nil {
+		t.Error("expected the wal to be closed")
+	}
+}
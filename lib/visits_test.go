@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVisitsDecay(t *testing.T) {
+	vs := OpenVisitStore(filepath.Join(t.TempDir(), "visits"), 1)
+	start := time.Unix(1000000, 0)
+	vs.Visit(1, start)
+	vs.Visit(1, start)
+	if score := vs.Frecency(1, start.Add(visitHalfLife)); math.Abs(score-1) > 1e-9 {
+		t.Errorf("expected two visits to be worth 1 a half life later but got %f", score)
+	}
+	vs.Visit(1, start.Add(2*visitHalfLife))
+	v, _ := vs.Get(1)
+	if v.Count != 3 || math.Abs(v.Score-1.5) > 1e-9 || v.Last != start.Add(2*visitHalfLife).UnixNano() {
+		t.Errorf("unexpected visits %v", v)
+	}
+	if vs.Frecency(2, start) != 0 {
+		t.Error("expected a file never visited to score 0")
+	}
+	if frecencyBonus(0) != 0 || frecencyBonus(1) != frecencyWeight {
+		t.Errorf("unexpected bonuses %d and %d", frecencyBonus(0), frecencyBonus(1))
+	}
+}
+
+func TestVisitRanking(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	short := filepath.Join(root, "visit.go")
+	long := filepath.Join(root, "visitlater.go")
+	touch(t, short)
+	touch(t, long)
+
+	s := testServer(t, root)
+	if matches := s.FindMatches("visit"); len(matches) != 2 || matches[0] != short {
+		t.Errorf("expected %s first but got %v", short, matches)
+	}
+	if err := s.Visit(long); err != nil {
+		t.Fatal(err)
+	}
+	if matches := s.FindMatches("visit"); len(matches) != 2 || matches[0] != long {
+		t.Errorf("expected the visited %s first but got %v", long, matches)
+	}
+	missing := filepath.Join(root, "missing.go")
+	if err := s.Visit(missing); err == nil {
+		t.Error("visited a path that is not indexed")
+	}
+	if unknown := s.VisitAll([]string{long, missing}); len(unknown) != 1 || unknown[0] != missing {
+		t.Errorf("expected only %s to be unknown but got %v", missing, unknown)
+	}
+
+	// as an editor saves, renaming a new file over the old one
+	s.ApplyChanges([]string{long}, []string{long}, nil)
+	id, err := s.stringids.GetId(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, found := s.visits.Get(id); !found || v.Count != 2 {
+		t.Errorf("expected 2 visits to be kept but got %v, %v", v, found)
+	}
+	s.StoreIndexIfDirty()
+	s.Close()
+
+	restarted := &Server{}
+	restarted.Init(s.config)
+	defer restarted.Close()
+	if matches := restarted.FindMatches("visit"); len(matches) != 2 || matches[0] != long {
+		t.Errorf("expected the visited %s first after restarting but got %v", long, matches)
+	}
+}
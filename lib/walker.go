@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"context"
+	"sync"
+)
+
+/*
+ Reading directories is bound by IO latency, more so on network mounts, so
+ walks read many directories at once. walkParallel is the skeleton every walk
+ shares: visit reads one directory and returns the ones to descend into,
+ which are handed to idle workers. When every worker is busy the current one
+ descends itself, which bounds the number of goroutines without ever blocking
+ on a full queue.
+
+ Directories are visited in no particular order, callers that want
+ reproducible results sort what they collect.
+*/
+
+const defaultWalkWorkers = 16
+
+func walkParallel[T any](ctx context.Context, workers int, root T, visit func(T) []T) error {
+	if workers < 1 {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers-1)
+	var wg sync.WaitGroup
+	var walk func(item T)
+	walk = func(item T) {
+		defer wg.Done()
+		if ctx.Err() != nil {
+			return
+		}
+		for _, child := range visit(item) {
+			wg.Add(1)
+			select {
+			case sem <- struct{}{}:
+				go func(child T) {
+					defer func() { <-sem }()
+					walk(child)
+				}(child)
+			default:
+				walk(child)
+			}
+		}
+	}
+	wg.Add(1)
+	walk(root)
+	wg.Wait()
+	return ctx.Err()
+}
@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// a tree of the given depth where every node has fanout children
+func children(fanout, depth int) func(string) []string {
+	return func(node string) []string {
+		if len(node) >= depth {
+			return nil
+		}
+		kids := make([]string, 0, fanout)
+		for i := 0; i < fanout; i++ {
+			kids = append(kids, fmt.Sprintf("%s%d", node, i))
+		}
+		return kids
+	}
+}
+
+func TestWalkParallelVisitsEverythingOnce(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	var running, maxRunning int32
+	kids := children(3, 5)
+	visit := func(node string) []string {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		mu.Lock()
+		seen[node]++
+		if n > maxRunning {
+			maxRunning = n
+		}
+		mu.Unlock()
+		return kids(node)
+	}
+	if err := walkParallel(context.Background(), 4, "", visit); err != nil {
+		t.Fatal(err)
+	}
+	// 1 + 3 + 9 + 27 + 81 + 243
+	if len(seen) != 364 {
+		t.Errorf("expected 364 nodes but saw %d", len(seen))
+	}
+	for node, count := range seen {
+		if count != 1 {
+			t.Errorf("%q visited %d times", node, count)
+		}
+	}
+	if maxRunning > 4 {
+		t.Errorf("expected at most 4 concurrent visits but saw %d", maxRunning)
+	}
+}
+
+func TestWalkParallelStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var visited int32
+	kids := children(3, 8)
+	visit := func(node string) []string {
+		if atomic.AddInt32(&visited, 1) == 10 {
+			cancel()
+		}
+		return kids(node)
+	}
+	if err := walkParallel(ctx, 4, "", visit); err != context.Canceled {
+		t.Errorf("expected context.Canceled but got %v", err)
+	}
+	if n := atomic.LoadInt32(&visited); n > 100 {
+		t.Errorf("kept walking after cancel, %d visits", n)
+	}
+}
@@ -0,0 +1,361 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+/*
+ Watcher keeps the index up to date from inotify events instead of walking
+ every root. Every directory under every root gets a watch, created and moved
+ in files are added to the index and deleted and moved out files are removed.
+ Files that are written to or have their mode changed are stat'ed again.
+ Events are applied in small batches, a few milliseconds after the first one
+ of a batch arrives. If the kernel drops events because the queue overflowed
+ we fall back to a full walk.
+*/
+
+// IN_CLOSE_WRITE and IN_ATTRIB keep the metadata of files current,
+// IN_CLOSE_WRITE notices edited ignore files as well.
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_ONLYDIR |
+	syscall.IN_DONT_FOLLOW
+
+// how long to wait for more events before applying a batch
+const watchBatchDelay = 100 * time.Millisecond
+
+// how often to store the index while events keep changing it
+const watchStoreEvery = time.Minute
+
+type Watcher struct {
+	s    *Server
+	file *os.File
+	fd   int
+
+	mu   sync.Mutex
+	dirs map[int32]string
+	wds  map[string]int32
+	// the patterns that apply to the entries of every watched directory
+	ignorers map[string]*Ignorer
+	roots    map[string]bool
+
+	// paths whose latest event was a create (true) or a delete (false)
+	pending     map[string]bool
+	pendingDirs []string
+	// files written to or chmod'ed, to be stat'ed again
+	modified map[string]bool
+	// directories whose ignore files changed
+	pendingIgnores map[string]bool
+	overflowed     bool
+}
+
+func NewWatcher(s *Server) (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		s:        s,
+		fd:       fd,
+		file:     os.NewFile(uintptr(fd), "inotify"),
+		dirs:     make(map[int32]string),
+		wds:      make(map[string]int32),
+		ignorers: make(map[string]*Ignorer),
+		pending:  make(map[string]bool),
+		modified: make(map[string]bool),
+		roots:    make(map[string]bool),
+
+		pendingIgnores: make(map[string]bool),
+	}
+	return w, nil
+}
+
+// Add watches dir and every directory under it that is not ignored, ig holds
+// the patterns of the directories above dir. Files found in the directories
+// are returned, they may have been created before the watches were in place.
+func (w *Watcher) Add(dir string, ig *Ignorer, isRoot bool) ([]string, error) {
+	ctx, cancel := context.WithCancel(w.s.ctx)
+	defer cancel()
+	var mu sync.Mutex
+	files := make([]string, 0)
+	var watchErr error
+	visit := func(job watchJob) []watchJob {
+		found, subdirs, err := w.add(job)
+		mu.Lock()
+		defer mu.Unlock()
+		files = append(files, found...)
+		if err != nil && watchErr == nil {
+			watchErr = err
+			cancel()
+		}
+		return subdirs
+	}
+	walkParallel(ctx, w.s.dirs.Workers, watchJob{dir: dir, ig: ig, isRoot: isRoot}, visit)
+	sort.Strings(files)
+	return files, watchErr
+}
+
+type watchJob struct {
+	dir    string
+	ig     *Ignorer
+	isRoot bool
+}
+
+// add watches a single directory and returns its files and the sub
+// directories to watch next.
+func (w *Watcher) add(job watchJob) ([]string, []watchJob, error) {
+	wd, err := syscall.InotifyAddWatch(w.fd, job.dir, watchMask)
+	if err != nil {
+		if err == syscall.ENOSPC {
+			return nil, nil, fmt.Errorf("out of inotify watches at %s, raise fs.inotify.max_user_watches", job.dir)
+		}
+		// gone already, permission denied and the like
+		return nil, nil, nil
+	}
+	entries, err := os.ReadDir(job.dir)
+	if err != nil {
+		return nil, nil, nil
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	ig := job.ig.With(job.dir, readIgnoreFiles(job.dir, names, job.isRoot))
+	w.mu.Lock()
+	w.dirs[int32(wd)] = job.dir
+	w.wds[job.dir] = int32(wd)
+	w.ignorers[job.dir] = ig
+	w.mu.Unlock()
+
+	files := make([]string, 0)
+	subdirs := make([]watchJob, 0)
+	for _, entry := range entries {
+		path := filepath.Join(job.dir, entry.Name())
+		if ig.Ignored(path, entry.IsDir()) {
+			continue
+		}
+		if entry.IsDir() {
+			subdirs = append(subdirs, watchJob{dir: path, ig: ig})
+		} else {
+			files = append(files, path)
+		}
+	}
+	return files, subdirs, nil
+}
+
+// Remove drops the watches of dir and of every directory under it.
+func (w *Watcher) Remove(dir string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for path, wd := range w.wds {
+		if underRoot(path, dir) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.wds, path)
+			delete(w.dirs, wd)
+			delete(w.ignorers, path)
+			delete(w.roots, path)
+		}
+	}
+}
+
+// AddRoot watches root, ig holds the global patterns.
+func (w *Watcher) AddRoot(root string, ig *Ignorer) ([]string, error) {
+	w.mu.Lock()
+	w.roots[root] = true
+	w.mu.Unlock()
+	return w.Add(root, ig, true)
+}
+
+func (w *Watcher) ignorer(dir string) *Ignorer {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ignorers[dir]
+}
+
+// rewatch drops and recreates the watches of dir and everything below it.
+func (w *Watcher) rewatch(dir string) {
+	w.mu.Lock()
+	isRoot := w.roots[dir]
+	w.mu.Unlock()
+	ig := w.s.dirs.RootIgnorer(dir)
+	if !isRoot {
+		ig = w.ignorer(filepath.Dir(dir))
+	}
+	w.Remove(dir)
+	if _, err := w.Add(dir, ig, isRoot); err != nil {
+		log.Println(err)
+	}
+}
+
+func (w *Watcher) Close() error {
+	return w.file.Close()
+}
+
+// Run reads events until the watcher is closed.
+func (w *Watcher) Run() {
+	events := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := w.file.Read(buf)
+			if err != nil {
+				close(events)
+				return
+			}
+			w.parse(buf[:n])
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	store := time.NewTicker(watchStoreEvery)
+	defer store.Stop()
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				w.s.StoreIndexIfDirty()
+				return
+			}
+			time.Sleep(watchBatchDelay)
+			w.apply()
+		case <-store.C:
+			w.s.StoreIndexIfDirty()
+		}
+	}
+}
+
+func (w *Watcher) parse(buf []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(buf) >= syscall.SizeofInotifyEvent {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[0]))
+		end := syscall.SizeofInotifyEvent + int(event.Len)
+		name := string(trimNul(buf[syscall.SizeofInotifyEvent:end]))
+		buf = buf[end:]
+
+		if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			w.overflowed = true
+			continue
+		}
+		dir, found := w.dirs[event.Wd]
+		if !found {
+			continue
+		}
+		if event.Mask&syscall.IN_IGNORED != 0 {
+			delete(w.dirs, event.Wd)
+			if w.wds[dir] == event.Wd {
+				delete(w.wds, dir)
+				delete(w.ignorers, dir)
+			}
+			continue
+		}
+		path := filepath.Join(dir, name)
+		isDir := event.Mask&syscall.IN_ISDIR != 0
+		if !isDir && event.Mask&syscall.IN_ATTRIB == 0 && isIgnoreFile(name, true) {
+			w.pendingIgnores[dir] = true
+		}
+		if w.ignorers[dir].Ignored(path, isDir) {
+			continue
+		}
+		switch {
+		case event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+			w.pending[path] = true
+		case isDir && event.Mask&(syscall.IN_MOVED_FROM|syscall.IN_DELETE) != 0:
+			// no events for what was inside a moved directory, drop it all
+			delete(w.pending, path)
+			w.pendingDirs = append(w.pendingDirs, path)
+		case event.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+			if !isDir {
+				w.pending[path] = false
+			}
+		case event.Mask&(syscall.IN_CLOSE_WRITE|syscall.IN_ATTRIB) != 0:
+			if !isDir {
+				w.modified[path] = true
+			}
+		}
+	}
+}
+
+func trimNul(bs []byte) []byte {
+	for i, b := range bs {
+		if b == 0 {
+			return bs[:i]
+		}
+	}
+	return bs
+}
+
+func (w *Watcher) apply() {
+	w.mu.Lock()
+	pending, removedDirs, overflowed := w.pending, w.pendingDirs, w.overflowed
+	ignores, modified := w.pendingIgnores, w.modified
+	w.pending = make(map[string]bool)
+	w.modified = make(map[string]bool)
+	w.pendingDirs = nil
+	w.pendingIgnores = make(map[string]bool)
+	w.overflowed = false
+	w.mu.Unlock()
+
+	if overflowed {
+		log.Println("inotify queue overflowed, reindexing everything")
+		w.s.Index()
+		return
+	}
+	if len(ignores) > 0 {
+		// what is ignored below changed, watch those directories anew and
+		// let a reindex sort out the files
+		for dir := range ignores {
+			w.rewatch(dir)
+		}
+		w.s.Index()
+		return
+	}
+	for _, dir := range removedDirs {
+		w.Remove(dir)
+	}
+	added := make([]string, 0)
+	removed := make([]string, 0)
+	for path, created := range pending {
+		if !created {
+			removed = append(removed, path)
+			continue
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			// already gone again
+			removed = append(removed, path)
+			continue
+		}
+		if !info.IsDir() {
+			added = append(added, path)
+			continue
+		}
+		files, err := w.Add(path, w.ignorer(filepath.Dir(path)), false)
+		if err != nil {
+			log.Println(err)
+		}
+		added = append(added, files...)
+	}
+	w.s.ApplyChanges(added, removed, removedDirs)
+	restat := make([]string, 0, len(modified))
+	for path := range modified {
+		// created and deleted files were taken care of
+		if _, found := pending[path]; !found {
+			restat = append(restat, path)
+		}
+	}
+	if len(restat) > 0 {
+		w.s.Restat(restat)
+	}
+}
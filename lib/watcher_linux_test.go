@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWatcherAppliesEvents(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	touch(t, filepath.Join(root, "existing.go"))
+	s := testServer(t, root)
+	if err := s.Watch(); err != nil {
+		t.Skip(err)
+	}
+	defer s.watcher.Close()
+	treeFiles := func() []string {
+		s.writeMu.Lock()
+		defer s.writeMu.Unlock()
+		return s.dirs.Files(root)
+	}
+
+	created := filepath.Join(root, "pkg", "nested", "created.go")
+	touch(t, created)
+	eventually(t, "created file", func() bool {
+		return contains(s.FindMatches("created"), created)
+	})
+	if !contains(treeFiles(), created) {
+		t.Errorf("expected %s in the directory tree", created)
+	}
+
+	if err := os.Remove(created); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "deleted file", func() bool {
+		return !contains(s.FindMatches("created"), created)
+	})
+
+	moved := filepath.Join(dir, "outside")
+	touch(t, filepath.Join(root, "pkg", "nested", "moving.go"))
+	eventually(t, "file in existing dir", func() bool {
+		return len(s.FindMatches("moving")) == 1
+	})
+	if err := os.Rename(filepath.Join(root, "pkg"), moved); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "moved out dir", func() bool {
+		return len(s.FindMatches("moving")) == 0
+	})
+	if files := treeFiles(); !sameStrings(files, []string{filepath.Join(root, "existing.go")}) {
+		t.Errorf("expected the directory tree to follow the events but got %v", files)
+	}
+}
+
+func TestWatcherRestatsWrittenFiles(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	file := filepath.Join(root, "written.sh")
+	writeFile(t, file, "x")
+	s := testServer(t, root)
+	if err := s.Watch(); err != nil {
+		t.Skip(err)
+	}
+	defer s.watcher.Close()
+	id, err := s.stringids.GetId(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, file, "0123456789")
+	eventually(t, "new size", func() bool {
+		meta, _ := s.meta.Get(id)
+		return meta.Size == 10
+	})
+	if err := os.Chmod(file, 0755); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "new mode", func() bool {
+		meta, _ := s.meta.Get(id)
+		return meta.Mode&ModeExec != 0
+	})
+}
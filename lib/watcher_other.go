@@ -0,0 +1,30 @@
+//go:build !linux
+
+package lib
+
+import "errors"
+
+// Filesystem events are only supported on linux, elsewhere the server falls
+// back to reindexing periodically.
+
+type Watcher struct{}
+
+func NewWatcher(s *Server) (*Watcher, error) {
+	return nil, errors.New("filesystem events are not supported on this platform")
+}
+
+func (w *Watcher) Add(dir string, ig *Ignorer, isRoot bool) ([]string, error) {
+	return nil, nil
+}
+
+func (w *Watcher) AddRoot(root string, ig *Ignorer) ([]string, error) {
+	return nil, nil
+}
+
+func (w *Watcher) Remove(dir string) {}
+
+func (w *Watcher) Close() error {
+	return nil
+}
+
+func (w *Watcher) Run() {}
@@ -6,16 +6,17 @@ import (
 	"github.com/pankajroark/pathsearch/lib"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 import _ "net/http/pprof"
 
-// todo instead of polling, listen to filesystem events using watchman or sth
-const indexEverySeconds = 600
-
-func scheduleIndex(s *lib.Server) {
-	ticker := time.NewTicker(indexEverySeconds * time.Second)
+// Polling is only used where filesystem events are not available.
+func scheduleIndex(s *lib.Server, every time.Duration) {
+	ticker := time.NewTicker(every)
 
 	go func() {
 		for {
@@ -29,18 +30,67 @@ func scheduleIndex(s *lib.Server) {
 }
 
 func main() {
-	// todo - referesh index periodically
-	serv := lib.Server{}
-	serv.Init()
-
 	port := flag.String("port", "10121", "port on which to run the wiki")
+	configPath := flag.String("config", lib.DefaultConfigPath(), "path to the config file")
+	indexPath := flag.String("index", "", "where to store the index, overrides the config file")
+	stringidsPath := flag.String("stringids", "", "where to store the path ids, overrides the config file")
+	roots := flag.String("roots", "", "comma separated roots to index, overrides the config file and roots added at runtime")
+	indexEvery := flag.Duration("interval", 0, "how often to reindex, overrides the config file")
+	fsync := flag.String("fsync", "", "when to sync path ids to disk, always, interval or never, overrides the config file")
 	flag.Parse()
+
+	config, err := lib.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("failed to load config %s: %v", *configPath, err)
+	}
+	if *indexPath != "" {
+		config.IndexPath = *indexPath
+	}
+	if *stringidsPath != "" {
+		config.StringidsPath = *stringidsPath
+	}
+	if *roots != "" {
+		if config.Roots, err = lib.ParseRoots(*roots); err != nil {
+			log.Fatal(err)
+		}
+		config.RootsOverride = true
+	}
+	if *indexEvery > 0 {
+		config.IndexEvery = *indexEvery
+	}
+	if *fsync != "" {
+		if _, err := lib.ParseSyncPolicy(*fsync); err != nil {
+			log.Fatal(err)
+		}
+		config.Fsync = *fsync
+	}
+
+	serv := lib.Server{}
+	serv.Init(config)
+
 	app := "pathsearch"
 	fmt.Printf("starting up %s on port %s ...\n", app, *port)
 	http.HandleFunc("/query", lib.CreateQueryHandler(&serv))
 	http.HandleFunc("/index", lib.CreateIndexHander(&serv))
 	http.HandleFunc("/addroot", lib.CreateAddRootHandler(&serv))
-	scheduleIndex(&serv)
+	http.HandleFunc("/removeroot", lib.CreateRemoveRootHandler(&serv))
+	http.HandleFunc("/roots", lib.CreateRootsHandler(&serv))
+	http.HandleFunc("/visit", lib.CreateVisitHandler(&serv))
+	http.HandleFunc("/visits", lib.CreateVisitBatchHandler(&serv))
+	go func() {
+		if err := serv.Watch(); err != nil {
+			fmt.Printf("Not watching for changes (%v), reindexing every %v\n", err, config.IndexEvery)
+			scheduleIndex(&serv, config.IndexEvery)
+		}
+	}()
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		fmt.Println("Shutting down...")
+		serv.Close()
+		os.Exit(0)
+	}()
 	/*
 		go func() {
 			log.Println(http.ListenAndServe("localhost:6060", nil))